@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/lhz/breadbox/pkg/gfx"
+
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"log"
+	"os"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %v [flags] <source> <target>\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+func main() {
+
+	crt := flag.Bool("crt", false, "Render as shown on a PAL monitor, with color bleed, scanlines and pixel aspect")
+	paletteName := flag.String("p", "colodore", "Name of palette to use [colodore|pepto|levy|vice|vice_new|vice_old], or a VICE .vpl file")
+	scale := flag.Int("scale", gfx.DefaultCRTParams.Scale, "Output rows per line of CRT preview")
+	scanlines := flag.Float64("scanlines", gfx.DefaultCRTParams.Scanlines, "Darkening (0-1) of the gaps between lines in CRT preview")
+
+	flag.Parse()
+
+	if len(flag.Args()) != 2 {
+		usage()
+	}
+
+	palette := gfx.PaletteByName(*paletteName)
+
+	sourceFile := flag.Arg(0)
+	targetFile := flag.Arg(1)
+
+	f, err := os.Open(sourceFile)
+	if err != nil {
+		log.Fatalf("Can't open file %s for reading: %v", sourceFile, err)
+		return
+	}
+	defer f.Close()
+
+	afli, err := gfx.ParseAFLI(f)
+	if err != nil {
+		log.Fatalf("Can't read from file %s: %v", sourceFile, err)
+		return
+	}
+
+	f, err = os.Create(targetFile)
+	if err != nil {
+		log.Fatalf("Can't open file %s for writing: %v", targetFile, err)
+		return
+	}
+	defer f.Close()
+	var rendered image.Image = afli.Render(palette)
+	if *crt {
+		params := gfx.DefaultCRTParams
+		params.Scale, params.Scanlines = *scale, *scanlines
+		rendered = gfx.CRTImage(rendered, params)
+	}
+	png.Encode(f, rendered)
+}
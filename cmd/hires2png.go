@@ -11,11 +11,6 @@ import (
 	"os"
 )
 
-var palette *gfx.Palette
-
-var mask = []byte{128, 64, 32, 16, 8, 4, 2, 1}
-var c byte
-
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage: %v [flags] <source> <target>\n", os.Args[0])
 	flag.PrintDefaults()
@@ -23,7 +18,10 @@ func usage() {
 }
 
 func main() {
-	paletteName := flag.String("p", "colodore", "Name of palette to use [colodore|pepto|levy|vice|vice_new|vice_old]")
+	crt := flag.Bool("crt", false, "Render as shown on a PAL monitor, with color bleed, scanlines and pixel aspect")
+	paletteName := flag.String("p", "colodore", "Name of palette to use [colodore|pepto|levy|vice|vice_new|vice_old], or a VICE .vpl file")
+	scale := flag.Int("scale", gfx.DefaultCRTParams.Scale, "Output rows per line of CRT preview")
+	scanlines := flag.Float64("scanlines", gfx.DefaultCRTParams.Scanlines, "Darkening (0-1) of the gaps between lines in CRT preview")
 
 	flag.Parse()
 
@@ -31,49 +29,35 @@ func main() {
 		usage()
 	}
 
-	palette = gfx.PaletteByName(*paletteName)
+	palette := gfx.PaletteByName(*paletteName)
 
 	sourceFile := flag.Arg(0)
 	targetFile := flag.Arg(1)
 
-	hires := make([]byte, 9194)
 	f, err := os.Open(sourceFile)
 	if err != nil {
 		log.Fatalf("Can't open file %s for reading: %v", sourceFile, err)
 		return
 	}
+	defer f.Close()
 
-	size, err := f.Read(hires)
+	hires, err := gfx.ParseHires(f)
 	if err != nil {
 		log.Fatalf("Can't read from file %s: %v", sourceFile, err)
 		return
 	}
 
-	screen := 8002
-	if size >= 9194 {
-		screen = 8194
-	}
-
-	img := image.NewPaletted(image.Rect(0, 0, 320, 200), palette.Colors)
-
-	for row := 0; row < 25; row++ {
-		for col := 0; col < 40; col++ {
-			scr := hires[screen+row*40+col]
-			for y := 0; y < 8; y++ {
-				byte := hires[2+row*320+col*8+y]
-				for x := 0; x < 8; x++ {
-					if byte&mask[x] > 0 {
-						c = (scr & 0xF0) >> 4
-					} else {
-						c = scr & 0x0F
-					}
-					img.Set(col*8+x, row*8+y, palette.Color(int(c)))
-				}
-			}
-		}
+	f, err = os.Create(targetFile)
+	if err != nil {
+		log.Fatalf("Can't open file %s for writing: %v", targetFile, err)
+		return
 	}
-
-	f, _ = os.OpenFile(targetFile, os.O_WRONLY|os.O_CREATE, 0600)
 	defer f.Close()
-	png.Encode(f, img)
+	var rendered image.Image = hires.Render(palette)
+	if *crt {
+		params := gfx.DefaultCRTParams
+		params.Scale, params.Scanlines = *scale, *scanlines
+		rendered = gfx.CRTImage(rendered, params)
+	}
+	png.Encode(f, rendered)
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"github.com/lhz/breadbox/pkg/gfx"
+
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %v [flags] list | show <palette> | convert <palette> <target> | generate [<target>]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "A palette is a name or a VICE .vpl file\n")
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+func main() {
+
+	var format, name string
+	params := gfx.DefaultPaletteParams
+	flag.Float64Var(&params.Brightness, "brightness", params.Brightness, "Brightness of generated palette (0-100, 50 for colodore)")
+	flag.Float64Var(&params.Contrast, "contrast", params.Contrast, "Contrast of generated palette (0-200, 100 for colodore)")
+	flag.StringVar(&format, "f", "", "Target format ["+strings.Join(gfx.PaletteFormats, "|")+"] (default: from target file extension)")
+	flag.Float64Var(&params.Gamma, "gamma", params.Gamma, "Display gamma of generated palette (1.0-3.0, 2.2 for colodore)")
+	flag.StringVar(&name, "name", "generated", "Name of generated palette")
+	flag.BoolVar(&params.NTSC, "ntsc", false, "Generate palette for an NTSC rather than a PAL machine")
+	flag.BoolVar(&params.OldRevision, "old", false, "Generate palette for the first VIC-II revision")
+	flag.Float64Var(&params.Saturation, "saturation", params.Saturation, "Saturation of generated palette (0-100, 50 for colodore)")
+
+	flag.Parse()
+
+	switch {
+	case flag.Arg(0) == "list" && len(flag.Args()) == 1:
+		names := []string{}
+		for name := range gfx.PaletteMap {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Println(name)
+		}
+	case flag.Arg(0) == "show" && len(flag.Args()) == 2:
+		showPalette(loadPalette(flag.Arg(1)))
+	case flag.Arg(0) == "convert" && len(flag.Args()) == 3:
+		writePalette(loadPalette(flag.Arg(1)), flag.Arg(2), format)
+	case flag.Arg(0) == "generate" && len(flag.Args()) == 1:
+		showPalette(gfx.GeneratePalette(name, params))
+	case flag.Arg(0) == "generate" && len(flag.Args()) == 2:
+		writePalette(gfx.GeneratePalette(name, params), flag.Arg(1), format)
+	default:
+		usage()
+	}
+}
+
+func showPalette(palette *gfx.Palette) {
+	for i, c := range palette.Colors {
+		r, g, b, _ := c.RGBA()
+		fmt.Printf("%2d  #%02x%02x%02x  %3d %3d %3d  %s\n", i, r>>8, g>>8, b>>8, r>>8, g>>8, b>>8, gfx.ColorNames[i])
+	}
+}
+
+// writePalette writes a palette in the given format, or the one named by
+// the target file extension
+func writePalette(palette *gfx.Palette, targetFile, format string) {
+	if len(format) == 0 {
+		format = strings.ToLower(strings.TrimPrefix(filepath.Ext(targetFile), "."))
+	}
+	if !validFormat(format) {
+		log.Fatalf("Invalid palette format %q", format)
+	}
+	out, err := os.Create(targetFile)
+	if err != nil {
+		log.Fatalf("Can't open file %s for writing: %v", targetFile, err)
+	}
+	defer out.Close()
+	if err := palette.Export(out, format); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadPalette returns the named palette, or reads it from a .vpl file
+func loadPalette(name string) *gfx.Palette {
+	if strings.HasSuffix(strings.ToLower(name), ".vpl") {
+		palette, err := gfx.LoadVPL(name)
+		if err != nil {
+			log.Fatalf("Can't read palette: %v", err)
+		}
+		return palette
+	}
+	palette, ok := gfx.PaletteMap[name]
+	if !ok {
+		log.Fatalf("Unknown palette %q", name)
+	}
+	return palette
+}
+
+func validFormat(format string) bool {
+	for _, f := range gfx.PaletteFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"github.com/lhz/breadbox/pkg/file"
+	"github.com/lhz/breadbox/pkg/gfx"
+
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"log"
+	"os"
+	"strings"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %v [flags] <source> <target>\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+func main() {
+
+	var crt, dump bool
+	var scale, set int
+	var scanlines float64
+	var bgCols, modeName, paletteName, romFile string
+	flag.StringVar(&bgCols, "b", "", "Background colors $D021-$D024 (0-15, comma-separated, default: from source)")
+	flag.BoolVar(&crt, "crt", false, "Render as shown on a PAL monitor, with color bleed, scanlines and pixel aspect")
+	flag.BoolVar(&dump, "dump", false, "Source is a memory dump rather than mempetscii output")
+	flag.StringVar(&modeName, "mode", "", "Text mode [standard|multi|ecm] (default: from memory dump, or standard)")
+	flag.StringVar(&paletteName, "p", "colodore", "Name of palette to use [colodore|pepto|levy|vice|vice_new|vice_old], or a VICE .vpl file")
+	flag.StringVar(&romFile, "rom", "", "Character ROM or charset file (default: charset in memory dump)")
+	flag.IntVar(&scale, "scale", gfx.DefaultCRTParams.Scale, "Output rows per line of CRT preview")
+	flag.Float64Var(&scanlines, "scanlines", gfx.DefaultCRTParams.Scanlines, "Darkening (0-1) of the gaps between lines in CRT preview")
+	flag.IntVar(&set, "set", -1, "Charset number in character ROM (default: as selected in memory dump, or 0)")
+
+	flag.Parse()
+
+	if len(flag.Args()) != 2 {
+		usage()
+	}
+
+	palette := gfx.PaletteByName(paletteName)
+
+	sourceFile := flag.Arg(0)
+	targetFile := flag.Arg(1)
+
+	var screen *gfx.TextScreen
+	if dump {
+		memory, err := file.ReadMemory(sourceFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		screen = &gfx.TextScreen{
+			Screen: memory.ScreenMatrix(),
+			Colors: memory.ColorMap(),
+			Mode:   gfx.StandardText,
+			Width:  40,
+			Height: 25}
+		for i := range screen.BgColors {
+			screen.BgColors[i] = memory.Peek(0xD021+i) & 15
+		}
+		if memory.Peek(0xD011)&0x40 != 0 {
+			screen.Mode = gfx.ExtendedColorText
+		} else if memory.Peek(0xD016)&0x10 != 0 {
+			screen.Mode = gfx.MulticolorText
+		}
+		address := memory.CharsetAddress()
+		if len(romFile) == 0 {
+			if memory.IsCharROM(address) {
+				log.Fatalf("Charset at $%04X is in character ROM, use -rom to give its contents", address)
+			}
+			screen.Charset = memory.Charset()
+		} else if set < 0 && memory.IsCharROM(address) {
+			set = (address >> 11) & 1
+		}
+	} else {
+		f, err := os.Open(sourceFile)
+		if err != nil {
+			log.Fatalf("Can't open file %s for reading: %v", sourceFile, err)
+		}
+		defer f.Close()
+		petscii, err := gfx.ParsePetscii(f)
+		if err != nil {
+			log.Fatalf("Can't read from file %s: %v", sourceFile, err)
+		}
+		if len(romFile) == 0 {
+			log.Fatal("A character ROM or charset file must be given with -rom")
+		}
+		screen = petscii.TextScreen(nil)
+	}
+
+	if len(romFile) > 0 {
+		if set < 0 {
+			set = 0
+		}
+		charset, err := gfx.ReadCharset(romFile, set)
+		if err != nil {
+			log.Fatal(err)
+		}
+		screen.Charset = charset
+	}
+	if len(modeName) > 0 {
+		mode, ok := gfx.TextModeMap[modeName]
+		if !ok {
+			log.Fatalf("Invalid text mode %q", modeName)
+		}
+		screen.Mode = mode
+	}
+	if len(bgCols) > 0 {
+		n := strings.Count(bgCols, ",") + 1
+		if n > 4 {
+			log.Fatalf("Too many background colors %q", bgCols)
+		}
+		colors, err := gfx.ParseColors(bgCols, n)
+		if err != nil {
+			log.Fatal(err)
+		}
+		copy(screen.BgColors[:], colors)
+	}
+
+	f, err := os.Create(targetFile)
+	if err != nil {
+		log.Fatalf("Can't open file %s for writing: %v", targetFile, err)
+	}
+	defer f.Close()
+	var rendered image.Image = screen.Render(palette)
+	if crt {
+		params := gfx.DefaultCRTParams
+		params.Scale, params.Scanlines = scale, scanlines
+		rendered = gfx.CRTImage(rendered, params)
+	}
+	png.Encode(f, rendered)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"github.com/lhz/breadbox/pkg/file"
+	"github.com/lhz/breadbox/pkg/gfx"
+
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %v [flags] <source> <target>\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+func main() {
+
+	var keep, resolve bool
+	var address, bugColumns, xOffset, yOffset int
+	var clashes, ditherName, distanceName, lock, paletteName string
+	flag.StringVar(&clashes, "c", "", "Output PNG showing color clashes.")
+	flag.StringVar(&ditherName, "d", "none", "Dithering [none|floyd-steinberg|atkinson|sierra|bayer2|bayer4|bayer8]")
+	flag.BoolVar(&keep, "k", false, "Keep each color in the slot it is first assigned to")
+	flag.StringVar(&lock, "l", "", "Lock colors to slots [hi|lo], e.g. 6=lo,14=hi")
+	flag.StringVar(&distanceName, "m", "redmean", "Color distance metric for non-palette colors [rgb|redmean|lab|de2000]")
+	flag.IntVar(&bugColumns, "n", 3, "Number of char columns to blank for the FLI bug")
+	flag.StringVar(&paletteName, "p", "", "Name of palette or VICE .vpl file to map colors to (default: best match)")
+	flag.BoolVar(&resolve, "r", false, "Resolve color clashes by remapping pixels")
+	flag.IntVar(&address, "s", 0x4000, "Start address of AFLI output")
+	flag.IntVar(&xOffset, "x", 0, "Offset X-coordinate of top left corner")
+	flag.IntVar(&yOffset, "y", 0, "Offset Y-coordinate of top left corner")
+
+	flag.Parse()
+
+	if len(flag.Args()) != 2 {
+		usage()
+	}
+
+	sourceFile := flag.Arg(0)
+	targetFile := flag.Arg(1)
+
+	source, err := gfx.ReadImage(sourceFile)
+	if err != nil {
+		log.Fatalf("Can't read image from file %s: %v", sourceFile, err)
+	}
+
+	image := gfx.FromImage(source, false, byte(0), gfx.OptionalPalette(paletteName), gfx.DistanceByName(distanceName))
+	image.Dither = gfx.DitherByName(ditherName)
+	image.Resolve = resolve
+	image.KeepSlots = keep
+	slots, err := gfx.ParseColorSlots(lock, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for c, slot := range slots {
+		image.SetColorSlot(c, slot)
+	}
+	image.WriteInexactReport(os.Stderr, 10)
+	afli := image.AFLI(xOffset, yOffset, bugColumns)
+
+	if resolve {
+		image.WriteClashReport(os.Stderr)
+	}
+	image.WriteSlotReport(os.Stderr)
+
+	if len(clashes) > 0 && len(image.Clashes) > 0 {
+		image.WriteClashesToPNG(clashes)
+	}
+
+	file.WriteBin(targetFile, address, afli.Bytes())
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"github.com/lhz/breadbox/pkg/file"
+	"github.com/lhz/breadbox/pkg/gfx"
+
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %v [flags] <source> <charset> <screen> <colors>\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+func main() {
+
+	var resolve bool
+	var address, screenAddress, colorsAddress, target, xOffset, yOffset int
+	var edgeWeight float64
+	var bgCol, clashes, distanceName, mColors, mode, paletteName, preview, registers string
+	flag.StringVar(&bgCol, "b", "0", "Background color (0-15, or auto to pick the one giving fewest clashes)")
+	flag.StringVar(&clashes, "c", "", "Output PNG showing color clashes.")
+	flag.StringVar(&mColors, "e", "auto", "Shared multicolors main,mcol1,mcol2 (0-15, main and mcol1 shared, mcol2 0-7 used by chars with no other color), or auto")
+	flag.StringVar(&distanceName, "m", "redmean", "Color distance metric for non-palette colors [rgb|redmean|lab|de2000]")
+	flag.StringVar(&mode, "mode", "multi", "Char mode [multi|hires|mixed|ecm], mixed and ecm picking all colors and writing color RAM instead of char colors")
+	flag.IntVar(&target, "n", 0, "Merge similar chars until at most this many remain (0: only when more than 256 are needed)")
+	flag.StringVar(&paletteName, "p", "", "Name of palette or VICE .vpl file to map colors to (default: best match)")
+	flag.StringVar(&registers, "regs", "", "Output background colors $D021-$D024 for mixed and ecm modes")
+	flag.BoolVar(&resolve, "r", false, "Resolve color clashes by remapping pixels")
+	flag.IntVar(&address, "s", 0x3800, "Start address of charset output")
+	flag.IntVar(&screenAddress, "t", 0x0400, "Start address of screen map output")
+	flag.IntVar(&colorsAddress, "u", -1, "Start address of char color output (default: charset address + $800)")
+	flag.StringVar(&preview, "v", "", "Output PNG showing the converted screen")
+	flag.Float64Var(&edgeWeight, "w", 0, "Extra weight of edge pixels when merging chars")
+	flag.IntVar(&xOffset, "x", 0, "Offset X-coordinate of top left corner")
+	flag.IntVar(&yOffset, "y", 0, "Offset Y-coordinate of top left corner")
+
+	flag.Parse()
+
+	if len(flag.Args()) != 4 {
+		usage()
+	}
+	if mode != "multi" && mode != "hires" && mode != "mixed" && mode != "ecm" {
+		log.Fatalf("Invalid char mode %q", mode)
+	}
+	if colorsAddress < 0 {
+		colorsAddress = address + 0x800
+	}
+
+	sourceFile := flag.Arg(0)
+
+	source, err := gfx.ReadImage(sourceFile)
+	if err != nil {
+		log.Fatalf("Can't read image from file %s: %v", sourceFile, err)
+	}
+
+	image := gfx.FromImage(source, mode == "multi", byte(0), gfx.OptionalPalette(paletteName), gfx.DistanceByName(distanceName))
+	image.Resolve = resolve
+	image.WriteInexactReport(os.Stderr, 10)
+
+	width, height := image.Size()
+	cols, rows := width/4, height/8
+	if mode != "multi" {
+		cols = width / 8
+	}
+
+	if mode == "mixed" || mode == "ecm" {
+		var screen *gfx.TextScreen
+		var changes []gfx.CharChange
+		if mode == "ecm" {
+			screen, changes = image.ECMText(xOffset, yOffset, cols, rows)
+		} else {
+			screen, changes = image.MixedText(xOffset, yOffset, cols, rows)
+		}
+		if len(changes) > 0 {
+			gfx.WriteCharChangeReport(os.Stderr, changes)
+		}
+		fmt.Fprintf(os.Stderr, "%d unique chars for %dx%d screen, background colors %v\n",
+			len(screen.Charset)/8, cols, rows, screen.BgColors)
+		if len(preview) > 0 {
+			if err := gfx.WritePNG(preview, screen.Render(image.MappedPalette())); err != nil {
+				log.Fatalf("Can't write preview to file %s: %v", preview, err)
+			}
+		}
+		if len(registers) > 0 {
+			file.WriteBin(registers, 0xD021, screen.BgColors[:])
+		}
+		file.WriteBin(flag.Arg(1), address, screen.Charset)
+		file.WriteBin(flag.Arg(2), screenAddress, screen.Screen)
+		file.WriteBin(flag.Arg(3), colorsAddress, screen.Colors)
+		return
+	}
+
+	options := gfx.CharsetOptions{BgColor: bgCol, MultiColors: mColors, Target: target, EdgeWeight: edgeWeight}
+	charset, err := image.ConvertCharset(xOffset, yOffset, cols, rows, options, os.Stderr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(clashes) > 0 && len(image.Clashes) > 0 {
+		image.WriteClashesToPNG(clashes)
+	}
+
+	if len(preview) > 0 {
+		if err := gfx.WritePNG(preview, charset.Render(image.MappedPalette())); err != nil {
+			log.Fatalf("Can't write preview to file %s: %v", preview, err)
+		}
+	}
+
+	file.WriteBin(flag.Arg(1), address, charset.Bytes())
+	file.WriteBin(flag.Arg(2), screenAddress, charset.Screen)
+	file.WriteBin(flag.Arg(3), colorsAddress, charset.Colors)
+}
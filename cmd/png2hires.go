@@ -6,6 +6,8 @@ import (
 
 	"flag"
 	"fmt"
+	"image/png"
+	"log"
 	"os"
 )
 
@@ -17,11 +19,22 @@ func usage() {
 
 func main() {
 
-	var align bool
-	var address, xOffset, yOffset int
-	var clashes string
+	var align, keep, resolve bool
+	var address, fixAddress, fixMax, xOffset, yOffset int
+	var clashes, ditherName, distanceName, fixPreview, fixSprites, fixTable, lock, paletteName string
 	flag.BoolVar(&align, "a", false, "Align screen to page")
 	flag.StringVar(&clashes, "c", "", "Output PNG showing color clashes.")
+	flag.StringVar(&ditherName, "d", "none", "Dithering [none|floyd-steinberg|atkinson|sierra|bayer2|bayer4|bayer8]")
+	flag.StringVar(&fixSprites, "g", "", "Output sprites covering pixels of clashing cells")
+	flag.IntVar(&fixAddress, "ga", 0x2000, "Start address of clash sprite output, its VIC bank is used for pointers")
+	flag.IntVar(&fixMax, "gn", 0, "Maximum number of clash sprites (0: no limit)")
+	flag.StringVar(&fixTable, "gt", "", "Output sprite pointers followed by multiplexing table for clash sprites, placed after the sprites")
+	flag.StringVar(&fixPreview, "gv", "", "Output PNG showing the picture with clash sprites")
+	flag.BoolVar(&keep, "k", false, "Keep each color in the slot it is first assigned to")
+	flag.StringVar(&lock, "l", "", "Lock colors to slots [hi|lo], e.g. 6=lo,14=hi")
+	flag.StringVar(&distanceName, "m", "redmean", "Color distance metric for non-palette colors [rgb|redmean|lab|de2000]")
+	flag.StringVar(&paletteName, "p", "", "Name of palette or VICE .vpl file to map colors to (default: best match)")
+	flag.BoolVar(&resolve, "r", false, "Resolve color clashes by remapping pixels")
 	flag.IntVar(&address, "s", 0x4000, "Start address of koala output")
 	flag.IntVar(&xOffset, "x", 0, "Offset X-coordinate of top left corner")
 	flag.IntVar(&yOffset, "y", 0, "Offset Y-coordinate of top left corner")
@@ -35,12 +48,53 @@ func main() {
 	sourceFile := flag.Arg(0)
 	targetFile := flag.Arg(1)
 
-	image := gfx.HiresImage(sourceFile, byte(0))
+	source, err := gfx.ReadImage(sourceFile)
+	if err != nil {
+		log.Fatalf("Can't read image from file %s: %v", sourceFile, err)
+	}
+
+	image := gfx.FromImage(source, false, byte(0), gfx.OptionalPalette(paletteName), gfx.DistanceByName(distanceName))
+	image.Dither = gfx.DitherByName(ditherName)
+	image.Resolve = resolve
+	image.KeepSlots = keep
+	slots, err := gfx.ParseColorSlots(lock, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for c, slot := range slots {
+		image.SetColorSlot(c, slot)
+	}
+	image.WriteInexactReport(os.Stderr, 10)
 	hires := image.Hires(xOffset, yOffset)
 
+	if resolve {
+		image.WriteClashReport(os.Stderr)
+	}
+	image.WriteSlotReport(os.Stderr)
+
 	if len(clashes) > 0 && len(image.Clashes) > 0 {
 		image.WriteClashesToPNG(clashes)
 	}
 
+	if len(fixSprites) > 0 || len(fixPreview) > 0 {
+		bitmap := hires.Render(image.MappedPalette())
+		fix := image.FixClashes(bitmap, xOffset, yOffset, fixMax)
+		fmt.Fprintf(os.Stderr, "%d clash sprites, %d pixels not fixed\n", len(fix.Sprites), fix.Unfixed)
+		if len(fixSprites) > 0 {
+			file.WriteBin(fixSprites, fixAddress, fix.Bytes())
+		}
+		if len(fixTable) > 0 {
+			file.WriteBin(fixTable, fixAddress+len(fix.Sprites)*64, append(fix.Pointers(fixAddress, fixAddress&0xC000), fix.Table()...))
+		}
+		if len(fixPreview) > 0 {
+			out, err := os.Create(fixPreview)
+			if err != nil {
+				log.Fatalf("Can't open file %s for writing: %v", fixPreview, err)
+			}
+			defer out.Close()
+			png.Encode(out, fix.Render(bitmap))
+		}
+	}
+
 	file.WriteBin(targetFile, address, hires.Bytes(align))
 }
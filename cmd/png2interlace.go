@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/lhz/breadbox/pkg/file"
+	"github.com/lhz/breadbox/pkg/gfx"
+
+	"flag"
+	"fmt"
+	"image/png"
+	"log"
+	"os"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %v [flags] <source> <target>\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+func main() {
+
+	var ifli bool
+	var address, bgCol, bugColumns, xOffset, yOffset int
+	var distanceName, paletteName, preview string
+	flag.IntVar(&bgCol, "b", 0, "Background color (0-15)")
+	flag.BoolVar(&ifli, "i", false, "Output IFLI as two FLI frames instead of Drazlace")
+	flag.StringVar(&distanceName, "m", "redmean", "Color distance metric [rgb|redmean|lab|de2000]")
+	flag.IntVar(&bugColumns, "n", 3, "Number of char columns to blank for the FLI bug in IFLI output")
+	flag.StringVar(&paletteName, "p", "", "Name of palette or VICE .vpl file to blend colors with (default: best match)")
+	flag.IntVar(&address, "s", -1, "Start address of output (default $5800 for Drazlace, $4000 for IFLI)")
+	flag.StringVar(&preview, "v", "", "Output PNG preview of the blended frames.")
+	flag.IntVar(&xOffset, "x", 0, "Offset X-coordinate of top left corner")
+	flag.IntVar(&yOffset, "y", 0, "Offset Y-coordinate of top left corner")
+
+	flag.Parse()
+
+	if len(flag.Args()) != 2 {
+		usage()
+	}
+
+	sourceFile := flag.Arg(0)
+	targetFile := flag.Arg(1)
+
+	source, err := gfx.ReadImage(sourceFile)
+	if err != nil {
+		log.Fatalf("Can't read image from file %s: %v", sourceFile, err)
+	}
+
+	image := gfx.FromImage(source, true, byte(bgCol), gfx.OptionalPalette(paletteName), gfx.DistanceByName(distanceName))
+	image.WriteInexactReport(os.Stderr, 10)
+	il := image.Interlace(xOffset, yOffset, ifli, bugColumns)
+
+	if len(preview) > 0 {
+		f, err := os.Create(preview)
+		if err != nil {
+			log.Fatalf("Can't open file %s for writing: %v", preview, err)
+		}
+		defer f.Close()
+		png.Encode(f, il.Render(image.MappedPalette()))
+	}
+
+	if ifli {
+		if address < 0 {
+			address = 0x4000
+		}
+		file.WriteBin(targetFile, address, il.FrameData())
+	} else {
+		if address < 0 {
+			address = 0x5800
+		}
+		file.WriteBin(targetFile, address, il.Drazlace())
+	}
+}
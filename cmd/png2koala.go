@@ -6,7 +6,10 @@ import (
 
 	"flag"
 	"fmt"
+	"image/png"
+	"log"
 	"os"
+	"strconv"
 )
 
 func usage() {
@@ -17,13 +20,24 @@ func usage() {
 
 func main() {
 
-	var align, front bool
-	var address, bgCol, xOffset, yOffset int
-	var clashes string
+	var align, front, keep, resolve bool
+	var address, fixAddress, fixMax, xOffset, yOffset int
+	var bgCol, clashes, ditherName, distanceName, fixPreview, fixSprites, fixTable, lock, paletteName string
 	flag.BoolVar(&align, "a", false, "Align screen and colormap to page")
-	flag.IntVar(&bgCol, "b", 0, "Background color (0-15)")
+	flag.StringVar(&bgCol, "b", "0", "Background color (0-15, or auto to pick the one giving fewest clashes)")
 	flag.StringVar(&clashes, "c", "", "Output PNG showing color clashes.")
+	flag.StringVar(&ditherName, "d", "none", "Dithering [none|floyd-steinberg|atkinson|sierra|bayer2|bayer4|bayer8]")
 	flag.BoolVar(&front, "f", false, "Put screen and color map data in front of bitmap data")
+	flag.StringVar(&fixSprites, "g", "", "Output sprites covering pixels of clashing cells")
+	flag.IntVar(&fixAddress, "ga", 0x2000, "Start address of clash sprite output, its VIC bank is used for pointers")
+	flag.IntVar(&fixMax, "gn", 0, "Maximum number of clash sprites (0: no limit)")
+	flag.StringVar(&fixTable, "gt", "", "Output sprite pointers followed by multiplexing table for clash sprites, placed after the sprites")
+	flag.StringVar(&fixPreview, "gv", "", "Output PNG showing the picture with clash sprites")
+	flag.BoolVar(&keep, "k", false, "Keep each color in the slot it is first assigned to")
+	flag.StringVar(&lock, "l", "", "Lock colors to slots [hi|lo|ram], e.g. 6=ram,14=hi")
+	flag.StringVar(&distanceName, "m", "redmean", "Color distance metric for non-palette colors [rgb|redmean|lab|de2000]")
+	flag.StringVar(&paletteName, "p", "", "Name of palette or VICE .vpl file to map colors to (default: best match)")
+	flag.BoolVar(&resolve, "r", false, "Resolve color clashes by remapping pixels")
 	flag.IntVar(&address, "s", 0x4000, "Start address of koala output")
 	flag.IntVar(&xOffset, "x", 0, "Offset X-coordinate of top left corner")
 	flag.IntVar(&yOffset, "y", 0, "Offset Y-coordinate of top left corner")
@@ -37,12 +51,66 @@ func main() {
 	sourceFile := flag.Arg(0)
 	targetFile := flag.Arg(1)
 
-	image := gfx.NewImage(sourceFile, true, byte(bgCol))
+	source, err := gfx.ReadImage(sourceFile)
+	if err != nil {
+		log.Fatalf("Can't read image from file %s: %v", sourceFile, err)
+	}
+
+	image := gfx.FromImage(source, true, byte(0), gfx.OptionalPalette(paletteName), gfx.DistanceByName(distanceName))
+	if bgCol == "auto" {
+		scores := image.RankBackgrounds(xOffset, yOffset)
+		for _, score := range scores {
+			fmt.Fprintf(os.Stderr, "Background %2d: %4d clashes, error %.1f\n", score.Colors[0], score.Clashes, score.Error)
+		}
+		image.BgColor = scores[0].Colors[0]
+	} else {
+		bg, err := strconv.Atoi(bgCol)
+		if err != nil || bg < 0 || bg > 15 {
+			log.Fatalf("Invalid background color %q", bgCol)
+		}
+		image.BgColor = byte(bg)
+	}
+	image.Dither = gfx.DitherByName(ditherName)
+	image.Resolve = resolve
+	image.KeepSlots = keep
+	slots, err := gfx.ParseColorSlots(lock, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for c, slot := range slots {
+		image.SetColorSlot(c, slot)
+	}
+	image.WriteInexactReport(os.Stderr, 10)
 	koala := image.Koala(xOffset, yOffset)
 
+	if resolve {
+		image.WriteClashReport(os.Stderr)
+	}
+	image.WriteSlotReport(os.Stderr)
+
 	if len(clashes) > 0 && len(image.Clashes) > 0 {
 		image.WriteClashesToPNG(clashes)
 	}
 
+	if len(fixSprites) > 0 || len(fixPreview) > 0 {
+		bitmap := koala.Render(image.MappedPalette())
+		fix := image.FixClashes(bitmap, xOffset, yOffset, fixMax)
+		fmt.Fprintf(os.Stderr, "%d clash sprites, %d pixels not fixed\n", len(fix.Sprites), fix.Unfixed)
+		if len(fixSprites) > 0 {
+			file.WriteBin(fixSprites, fixAddress, fix.Bytes())
+		}
+		if len(fixTable) > 0 {
+			file.WriteBin(fixTable, fixAddress+len(fix.Sprites)*64, append(fix.Pointers(fixAddress, fixAddress&0xC000), fix.Table()...))
+		}
+		if len(fixPreview) > 0 {
+			out, err := os.Create(fixPreview)
+			if err != nil {
+				log.Fatalf("Can't open file %s for writing: %v", fixPreview, err)
+			}
+			defer out.Close()
+			png.Encode(out, fix.Render(bitmap))
+		}
+	}
+
 	file.WriteBin(targetFile, address, koala.Bytes(align, front))
 }
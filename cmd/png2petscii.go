@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/lhz/breadbox/pkg/file"
+	"github.com/lhz/breadbox/pkg/gfx"
+
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %v [flags] <source> <charrom> <target>\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+func main() {
+
+	var address, set, xOffset, yOffset int
+	var bgCol, distanceName, paletteName string
+	flag.StringVar(&bgCol, "b", "auto", "Background color (0-15, or auto to use the most common color)")
+	flag.StringVar(&distanceName, "m", "redmean", "Color distance metric [rgb|redmean|lab|de2000]")
+	flag.StringVar(&paletteName, "p", "", "Name of palette or VICE .vpl file to map colors to (default: best match)")
+	flag.IntVar(&address, "s", 0x8000, "Start address of output")
+	flag.IntVar(&set, "set", 0, "Charset number in character ROM (0: uppercase/graphics, 1: lowercase/uppercase)")
+	flag.IntVar(&xOffset, "x", 0, "Offset X-coordinate of top left corner")
+	flag.IntVar(&yOffset, "y", 0, "Offset Y-coordinate of top left corner")
+
+	flag.Parse()
+
+	if len(flag.Args()) != 3 {
+		usage()
+	}
+
+	sourceFile := flag.Arg(0)
+	romFile := flag.Arg(1)
+	targetFile := flag.Arg(2)
+
+	source, err := gfx.ReadImage(sourceFile)
+	if err != nil {
+		log.Fatalf("Can't read image from file %s: %v", sourceFile, err)
+	}
+	charset, err := gfx.ReadCharset(romFile, set)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	image := gfx.FromImage(source, false, byte(0), gfx.OptionalPalette(paletteName), gfx.DistanceByName(distanceName))
+	image.WriteInexactReport(os.Stderr, 10)
+	if bgCol == "auto" {
+		image.BgColor = image.MostUsedColor()
+		fmt.Fprintf(os.Stderr, "Background %d\n", image.BgColor)
+	} else {
+		bg, err := strconv.Atoi(bgCol)
+		if err != nil || bg < 0 || bg > 15 {
+			log.Fatalf("Invalid background color %q", bgCol)
+		}
+		image.BgColor = byte(bg)
+	}
+
+	petscii := image.Petscii(xOffset, yOffset, charset)
+	fmt.Fprintf(os.Stderr, "Total error %.1f\n", petscii.Error)
+
+	file.WriteBin(targetFile, address, petscii.Bytes())
+}
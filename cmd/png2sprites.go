@@ -0,0 +1,154 @@
+package main
+
+import (
+	"github.com/lhz/breadbox/pkg/file"
+	"github.com/lhz/breadbox/pkg/gfx"
+
+	"flag"
+	"fmt"
+	"image/png"
+	"log"
+	"os"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %v [flags] <source> <sprites> <pointers> [<colors>]\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+func main() {
+
+	var skipDuplicates, skipEmpty bool
+	var address, bank, bgCol, colorsAddress, cols, rows, pointersAddress, xOffset, yOffset int
+	var distanceName, mColors, mode, paletteName, preview, spriteColor string
+	flag.IntVar(&bgCol, "b", 0, "Background color (0-15), left transparent")
+	flag.IntVar(&bank, "bank", 0x0000, "Start address of the VIC bank the sprites are shown from")
+	flag.IntVar(&cols, "cols", 0, "Number of sprite columns in the grid (default: as many as fit)")
+	flag.BoolVar(&skipDuplicates, "dup", false, "Store repeated sprites only once")
+	flag.StringVar(&mColors, "e", "auto", "Shared multicolors $D025,$D026 (0-15), or auto")
+	flag.BoolVar(&skipEmpty, "empty", false, "Leave out empty sprites")
+	flag.StringVar(&spriteColor, "k", "auto", "Sprite color (0-15), or auto to pick one for each sprite")
+	flag.StringVar(&distanceName, "m", "redmean", "Color distance metric for non-palette colors [rgb|redmean|lab|de2000]")
+	flag.StringVar(&mode, "mode", "hires", "Sprite mode [hires|multi|layered], layered splitting each hires frame into a multicolor underlay and a hires overlay")
+	flag.StringVar(&paletteName, "p", "", "Name of palette or VICE .vpl file to map colors to (default: best match)")
+	flag.IntVar(&rows, "rows", 0, "Number of sprite rows in the grid (default: as many as fit)")
+	flag.IntVar(&address, "s", 0x2000, "Start address of sprite output, rounded up to a multiple of 64")
+	flag.IntVar(&pointersAddress, "t", 0x07F8, "Start address of sprite pointer output")
+	flag.IntVar(&colorsAddress, "u", -1, "Start address of sprite color output (default: pointer address + number of pointers)")
+	flag.StringVar(&preview, "v", "", "Output PNG showing the layered sprites")
+	flag.IntVar(&xOffset, "x", 0, "Offset X-coordinate of top left corner")
+	flag.IntVar(&yOffset, "y", 0, "Offset Y-coordinate of top left corner")
+
+	flag.Parse()
+
+	if len(flag.Args()) != 3 && len(flag.Args()) != 4 {
+		usage()
+	}
+	if mode != "multi" && mode != "hires" && mode != "layered" {
+		log.Fatalf("Invalid sprite mode %q", mode)
+	}
+	if address%64 != 0 {
+		address += 64 - address%64
+		fmt.Fprintf(os.Stderr, "Sprite address rounded up to $%04X\n", address)
+	}
+
+	sourceFile := flag.Arg(0)
+
+	source, err := gfx.ReadImage(sourceFile)
+	if err != nil {
+		log.Fatalf("Can't read image from file %s: %v", sourceFile, err)
+	}
+
+	image := gfx.FromImage(source, mode == "multi", byte(bgCol), gfx.OptionalPalette(paletteName), gfx.DistanceByName(distanceName))
+	image.WriteInexactReport(os.Stderr, 10)
+
+	width, height := image.Size()
+	spriteWidth := 24
+	var shared []byte
+	if mode == "multi" {
+		spriteWidth = 12
+	}
+	if mode != "hires" {
+		if mColors != "auto" {
+			shared, err = gfx.ParseColors(mColors, 2)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	color := -1
+	if spriteColor != "auto" {
+		if mode == "layered" {
+			log.Fatal("Sprite color can't be given in layered mode")
+		}
+		colors, err := gfx.ParseColors(spriteColor, 1)
+		if err != nil {
+			log.Fatal(err)
+		}
+		color = int(colors[0])
+	}
+	if cols <= 0 {
+		cols = (width - xOffset) / spriteWidth
+	}
+	if rows <= 0 {
+		rows = (height - yOffset) / 21
+	}
+
+	var data, pointers, spriteColors []byte
+	if mode == "layered" {
+		layers := image.LayerSprites(xOffset, yOffset, cols, rows, shared, skipEmpty, skipDuplicates)
+		fmt.Fprintf(os.Stderr, "Multicolors $D025=%d, $D026=%d\n", layers.Shared[0], layers.Shared[1])
+		for i, index := range layers.Underlay.Frames {
+			if index >= 0 {
+				fmt.Fprintf(os.Stderr, "Frame %3d at x=%3d, y=%3d: underlay %3d color %2d, overlay %3d color %2d\n",
+					i, xOffset+(i%cols)*spriteWidth, yOffset+(i/cols)*21,
+					index, layers.Underlay.Colors[i], layers.Overlay.Frames[i], layers.Overlay.Colors[i])
+			}
+		}
+		image.WriteClashReport(os.Stderr)
+		fmt.Fprintf(os.Stderr, "%d underlay and %d overlay sprites for %d frames, %d pixels lost, error %.1f\n",
+			len(layers.Underlay.Sprites), len(layers.Overlay.Sprites), len(layers.Underlay.Frames), layers.Lost, layers.Error)
+		overlayAddress := address + len(layers.Underlay.Sprites)*64
+		data = append(layers.Underlay.Bytes(), layers.Overlay.Bytes()...)
+		pointers = append(layers.Underlay.Pointers(address, bank), layers.Overlay.Pointers(overlayAddress, bank)...)
+		spriteColors = append(layers.Underlay.SpriteColors(), layers.Overlay.SpriteColors()...)
+		if len(preview) > 0 {
+			out, err := os.Create(preview)
+			if err != nil {
+				log.Fatalf("Can't open file %s for writing: %v", preview, err)
+			}
+			defer out.Close()
+			png.Encode(out, layers.Render(image.MappedPalette()))
+		}
+	} else {
+		colors := image.ChooseSpriteColors(xOffset, yOffset, cols, rows, shared, color)
+		if mode == "multi" {
+			fmt.Fprintf(os.Stderr, "Multicolors $D025=%d, $D026=%d\n", colors.Shared[0], colors.Shared[1])
+		}
+		sheet := image.SpriteSheet(xOffset, yOffset, cols, rows, colors, skipEmpty, skipDuplicates)
+		for i, index := range sheet.Frames {
+			if index >= 0 {
+				fmt.Fprintf(os.Stderr, "Sprite %3d at x=%3d, y=%3d: color %2d\n",
+					index, xOffset+(i%cols)*spriteWidth, yOffset+(i/cols)*21, sheet.Colors[i])
+			}
+		}
+		image.WriteClashReport(os.Stderr)
+		fmt.Fprintf(os.Stderr, "%d sprites for %d frames\n", len(sheet.Sprites), len(sheet.Frames))
+		data = sheet.Bytes()
+		pointers = sheet.Pointers(address, bank)
+		spriteColors = sheet.SpriteColors()
+	}
+	if address < bank || address+len(data) > bank+0x4000 {
+		log.Fatalf("Sprites at $%04X-$%04X do not fit in VIC bank at $%04X", address, address+len(data)-1, bank)
+	}
+
+	file.WriteBin(flag.Arg(1), address, data)
+	file.WriteBin(flag.Arg(2), pointersAddress, pointers)
+	if len(flag.Args()) == 4 {
+		if colorsAddress < 0 {
+			colorsAddress = pointersAddress + len(pointers)
+		}
+		file.WriteBin(flag.Arg(3), colorsAddress, spriteColors)
+	}
+}
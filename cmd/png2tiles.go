@@ -0,0 +1,101 @@
+package main
+
+import (
+	"github.com/lhz/breadbox/pkg/file"
+	"github.com/lhz/breadbox/pkg/gfx"
+
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %v [flags] <source> <charset> <tiles> <map>\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+func main() {
+
+	var columnMajor, resolve bool
+	var address, tilesAddress, mapAddress, target, xOffset, yOffset int
+	var edgeWeight float64
+	var bgCol, clashes, distanceName, mColors, mode, paletteName, preview, tileSize string
+	flag.StringVar(&bgCol, "b", "0", "Background color (0-15, or auto to pick the one giving fewest clashes)")
+	flag.StringVar(&clashes, "c", "", "Output PNG showing color clashes.")
+	flag.BoolVar(&columnMajor, "col", false, "Store tile chars and map column by column instead of row by row")
+	flag.StringVar(&mColors, "e", "auto", "Shared multicolors main,mcol1,mcol2 (0-15, main and mcol1 shared, mcol2 0-7 used by chars with no other color), or auto")
+	flag.StringVar(&distanceName, "m", "redmean", "Color distance metric for non-palette colors [rgb|redmean|lab|de2000]")
+	flag.StringVar(&mode, "mode", "multi", "Char mode [multi|hires]")
+	flag.IntVar(&target, "n", 0, "Merge similar chars until at most this many remain (0: only when more than 256 are needed)")
+	flag.StringVar(&paletteName, "p", "", "Name of palette or VICE .vpl file to map colors to (default: best match)")
+	flag.BoolVar(&resolve, "r", false, "Resolve color clashes by remapping pixels")
+	flag.IntVar(&address, "s", 0x3800, "Start address of charset output")
+	flag.StringVar(&tileSize, "size", "2x2", "Tile size in chars, as WxH")
+	flag.IntVar(&tilesAddress, "t", 0x3000, "Start address of tile definitions output")
+	flag.IntVar(&mapAddress, "u", 0x4000, "Start address of tile map output")
+	flag.StringVar(&preview, "v", "", "Output PNG showing the converted image")
+	flag.Float64Var(&edgeWeight, "w", 0, "Extra weight of edge pixels when merging chars")
+	flag.IntVar(&xOffset, "x", 0, "Offset X-coordinate of top left corner")
+	flag.IntVar(&yOffset, "y", 0, "Offset Y-coordinate of top left corner")
+
+	flag.Parse()
+
+	if len(flag.Args()) != 4 {
+		usage()
+	}
+	if mode != "multi" && mode != "hires" {
+		log.Fatalf("Invalid char mode %q", mode)
+	}
+	var tileWidth, tileHeight int
+	if n, err := fmt.Sscanf(tileSize, "%dx%d", &tileWidth, &tileHeight); n != 2 || err != nil || tileWidth < 1 || tileHeight < 1 {
+		log.Fatalf("Invalid tile size %q", tileSize)
+	}
+
+	sourceFile := flag.Arg(0)
+
+	source, err := gfx.ReadImage(sourceFile)
+	if err != nil {
+		log.Fatalf("Can't read image from file %s: %v", sourceFile, err)
+	}
+
+	image := gfx.FromImage(source, mode == "multi", byte(0), gfx.OptionalPalette(paletteName), gfx.DistanceByName(distanceName))
+	image.Resolve = resolve
+	image.WriteInexactReport(os.Stderr, 10)
+
+	width, height := image.Size()
+	cols, rows := width/4, height/8
+	if mode == "hires" {
+		cols = width / 8
+	}
+
+	options := gfx.CharsetOptions{BgColor: bgCol, MultiColors: mColors, Target: target, EdgeWeight: edgeWeight}
+	charset, err := image.ConvertCharset(xOffset, yOffset, cols, rows, options, os.Stderr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(clashes) > 0 && len(image.Clashes) > 0 {
+		image.WriteClashesToPNG(clashes)
+	}
+
+	tiles, err := charset.Tiles(tileWidth, tileHeight, columnMajor)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(tiles.Recolored) > 0 {
+		gfx.WriteTileRecolorReport(os.Stderr, tiles.Recolored)
+	}
+	fmt.Fprintf(os.Stderr, "%d unique %dx%d tiles for %dx%d map\n", len(tiles.Tiles), tileWidth, tileHeight, tiles.Width, tiles.Height)
+
+	if len(preview) > 0 {
+		if err := gfx.WritePNG(preview, tiles.Render(charset, image.MappedPalette())); err != nil {
+			log.Fatalf("Can't write preview to file %s: %v", preview, err)
+		}
+	}
+
+	file.WriteBin(flag.Arg(1), address, charset.Bytes())
+	file.WriteBin(flag.Arg(2), tilesAddress, tiles.Bytes())
+	file.WriteBin(flag.Arg(3), mapAddress, tiles.Map)
+}
@@ -53,6 +53,31 @@ func (m *Memory) ScreenMatrix() []byte {
 	return bytes
 }
 
+// CharsetAddress returns the address of the charset selected by $D018 in
+// the VIC bank selected by $DD00
+func (m *Memory) CharsetAddress() int {
+	bank := 0x4000 * (3 - (int(m.Peek(0xDD00)) % 4))
+	return bank + 0x0800*((int(m.Peek(0xD018))>>1)&7)
+}
+
+// IsCharROM tells whether the VIC-II sees the character ROM rather than
+// RAM at the given address, which is the case at $1000-$1FFF in banks 0
+// and 2
+func (m *Memory) IsCharROM(address int) bool {
+	return address&0x7000 == 0x1000
+}
+
+// Charset returns the 2048 bytes of the charset selected by $D018
+func (m *Memory) Charset() []byte {
+	charset := m.CharsetAddress()
+	log.Printf("Charset is at $%04X", charset)
+	bytes, err := m.Read(charset, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return bytes
+}
+
 func (m *Memory) ColorMap() []byte {
 	bytes, err := m.Read(0xD800, 1000)
 	if err != nil {
@@ -0,0 +1,109 @@
+package gfx
+
+import (
+	"bytes"
+	"fmt"
+	img "image"
+	"io"
+	"os"
+)
+
+// Sizes of AFLI data without load address, with and without padding
+// after the bitmap
+const (
+	afliSize   = 16192
+	afliPadded = 16384
+)
+
+// AFLI represents a full-screen hires FLI image, which has a separate
+// screen for each of the 8 pixel rows of a char row
+type AFLI struct {
+	Bitmap  []byte
+	Screens [][]byte
+}
+
+// Bytes returns AFLI data in the layout used by AFLI editors, to be
+// loaded at $4000: the 8 screens, each aligned to 1024 bytes, followed
+// by the bitmap.
+func (afli *AFLI) Bytes() []byte {
+	segments := [][]byte{}
+	for _, screen := range afli.Screens {
+		segments = append(segments, screen, make([]byte, 24))
+	}
+	segments = append(segments, afli.Bitmap)
+	return bytes.Join(segments, []byte{})
+}
+
+// ColorAt returns the color index of the pixel at x (0-319), y (0-199)
+func (afli *AFLI) ColorAt(x, y int) byte {
+	scr := afli.Screens[y%8][(y/8)*40+x/8]
+	if afli.Bitmap[(y/8)*320+(x/8)*8+y%8]&(0x80>>uint(x%8)) != 0 {
+		return scr >> 4
+	}
+	return scr & 0x0F
+}
+
+// Render returns the AFLI image as a 320x200 paletted image using the
+// given palette
+func (afli *AFLI) Render(palette *Palette) *img.Paletted {
+	rendered := img.NewPaletted(img.Rect(0, 0, 320, 200), palette.Colors)
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 320; x++ {
+			rendered.SetColorIndex(x, y, afli.ColorAt(x, y))
+		}
+	}
+	return rendered
+}
+
+// ParseAFLI reads AFLI data in the layout produced by Bytes, with or
+// without load address and padding after the bitmap.
+func ParseAFLI(r io.Reader) (*AFLI, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	switch len(data) {
+	case afliSize + 2, afliPadded + 2:
+		data = data[2:]
+	}
+	if len(data) != afliSize && len(data) != afliPadded {
+		return nil, fmt.Errorf("Unexpected size of AFLI data: %d bytes", len(data))
+	}
+	afli := AFLI{
+		Bitmap:  make([]byte, 8000),
+		Screens: make([][]byte, 8)}
+	for i := range afli.Screens {
+		afli.Screens[i] = make([]byte, 1000)
+		copy(afli.Screens[i], data[1024*i:])
+	}
+	copy(afli.Bitmap, data[8192:])
+	return &afli, nil
+}
+
+// AFLI extracts a full-screen 320x200 hires image in AFLI format, where
+// colors are limited per 8x1 pixel row. The leftmost bugColumns char
+// columns, which are hidden by the FLI bug, are left blank.
+func (image *Image) AFLI(xoffset, yoffset, bugColumns int) *AFLI {
+	afli := AFLI{
+		Bitmap:  make([]byte, 8000),
+		Screens: make([][]byte, 8)}
+	for i := range afli.Screens {
+		afli.Screens[i] = make([]byte, 1000)
+	}
+	image.dither(img.Rect(xoffset, yoffset, xoffset+320, yoffset+200), 8, 1, func(x, y int) []byte {
+		return nil
+	}, 2)
+	for row := 0; row < 25; row++ {
+		for col := bugColumns; col < 40; col++ {
+			for y := 0; y < 8; y++ {
+				cell, err := image.hiresCell(xoffset+col*8, yoffset+row*8+y, 1)
+				if err != nil {
+					os.Stderr.WriteString(err.Error())
+				}
+				afli.Bitmap[row*320+col*8+y] = cell[0]
+				afli.Screens[y][row*40+col] = cell[1]
+			}
+		}
+	}
+	return &afli
+}
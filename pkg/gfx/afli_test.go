@@ -0,0 +1,36 @@
+package gfx
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestAFLIRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(6))
+	afli := &AFLI{
+		Bitmap:  randomBytes(rng, 8000, 256),
+		Screens: make([][]byte, 8)}
+	for i := range afli.Screens {
+		afli.Screens[i] = randomBytes(rng, 1000, 256)
+	}
+	data := afli.Bytes()
+	if len(data) != afliSize {
+		t.Fatalf("got %d bytes, want %d", len(data), afliSize)
+	}
+	padded := append(append([]byte{}, data...), make([]byte, afliPadded-afliSize)...)
+	for _, file := range [][]byte{data, withLoadAddress(0x4000, data), padded, withLoadAddress(0x4000, padded)} {
+		parsed, err := ParseAFLI(bytes.NewReader(file))
+		if err != nil {
+			t.Errorf("%d bytes: %v", len(file), err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed, afli) {
+			t.Errorf("%d bytes: parsed image differs", len(file))
+		}
+		if !bytes.Equal(parsed.Bytes(), data) {
+			t.Errorf("%d bytes: bytes differ after round trip", len(file))
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package gfx
+
+import (
+	"bytes"
+	"fmt"
+	img "image"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Charset represents a character set together with a screen map of char
+// indices and a color RAM value for each char
+type Charset struct {
+	Chars       [][]byte
+	Colors      []byte
+	Screen      []byte
+	Width       int
+	Height      int
+	Multicolor  bool
+	BgColor     byte
+	MultiColors []byte
+	cells       []int
+	xoffset     int
+	yoffset     int
+}
+
+// CharChange describes a screen cell whose char was replaced by a similar
+// one when reducing a charset, with From numbered as before the reduction
+// and To as after it
+type CharChange struct {
+	X, Y     int
+	From, To int
+	Error    float64
+}
+
+// Bytes returns the char data of the charset as raw bytes
+func (charset *Charset) Bytes() []byte {
+	return bytes.Join(charset.Chars, []byte{})
+}
+
+// ParseColors parses a comma-separated list of n color indices
+func ParseColors(spec string, n int) ([]byte, error) {
+	values := strings.Split(spec, ",")
+	if len(values) != n {
+		return nil, fmt.Errorf("Invalid list of %d colors %q", n, spec)
+	}
+	colors := make([]byte, n)
+	for i, value := range values {
+		c, err := strconv.Atoi(value)
+		if err != nil || c < 0 || c > 15 {
+			return nil, fmt.Errorf("Invalid color %q in %q", value, spec)
+		}
+		colors[i] = byte(c)
+	}
+	return colors, nil
+}
+
+// CharPixels returns the color indices of the pixels of a char, with
+// multicolor pixels counted as one
+func (charset *Charset) CharPixels(index int) [][]byte {
+	char := charset.Chars[index]
+	color := charset.Colors[index]
+	width := 8
+	if charset.Multicolor {
+		width = 4
+	}
+	pixels := make([][]byte, 8)
+	for y := range pixels {
+		pixels[y] = make([]byte, width)
+		for x := range pixels[y] {
+			if charset.Multicolor {
+				switch (char[y] >> uint(6-x*2)) & 3 {
+				case 0:
+					pixels[y][x] = charset.BgColor
+				case 1:
+					pixels[y][x] = charset.MultiColors[0]
+				case 2:
+					pixels[y][x] = charset.MultiColors[1]
+				case 3:
+					pixels[y][x] = color & 7
+				}
+			} else if (char[y]>>uint(7-x))&1 == 1 {
+				pixels[y][x] = color & 15
+			} else {
+				pixels[y][x] = charset.BgColor
+			}
+		}
+	}
+	return pixels
+}
+
+// TextScreen returns the screen map and charset as a text screen in
+// standard or multicolor text mode
+func (charset *Charset) TextScreen() *TextScreen {
+	screen := TextScreen{
+		Screen:   charset.Screen,
+		Colors:   make([]byte, len(charset.Screen)),
+		Charset:  charset.Bytes(),
+		BgColors: [4]byte{charset.BgColor},
+		Width:    charset.Width,
+		Height:   charset.Height}
+	if charset.Multicolor {
+		screen.Mode = MulticolorText
+		copy(screen.BgColors[1:3], charset.MultiColors)
+	}
+	for i, index := range charset.cells {
+		screen.Colors[i] = charset.Colors[index]
+	}
+	return &screen
+}
+
+// Render returns the screen map shown with the charset as a paletted image
+// using the given palette, with each multicolor pixel two pixels wide.
+// The charset must have no more than 256 chars.
+func (charset *Charset) Render(palette *Palette) *img.Paletted {
+	return charset.TextScreen().Render(palette)
+}
+
+// Charset extracts a charset covering cols x rows chars at the given
+// offset, using MulticolorChar or HiresChar depending on the image type.
+// Identical chars with the same color are only stored once. If more than
+// 256 chars are needed, all of them are returned along with an error.
+// No charset is returned if the multicolor set for chars using no other
+// color is above 7.
+func (image *Image) Charset(xoffset, yoffset, cols, rows int) (*Charset, error) {
+	charset := Charset{
+		Chars:      [][]byte{},
+		Colors:     []byte{},
+		Screen:     make([]byte, cols*rows),
+		cells:      make([]int, cols*rows),
+		Width:      cols,
+		Height:     rows,
+		Multicolor: image.mcol,
+		BgColor:    image.BgColor,
+		xoffset:    xoffset,
+		yoffset:    yoffset}
+	width := 8
+	if image.mcol {
+		width = 4
+		if image.mColors != nil {
+			if err := checkCharFallback(image.mColors[2]); err != nil {
+				return nil, err
+			}
+			charset.MultiColors = image.mColors[0:2]
+		}
+	}
+	indices := map[string]int{}
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			var char []byte
+			var err error
+			if image.mcol {
+				char, err = image.MulticolorChar(xoffset+col*width, yoffset+row*8)
+			} else {
+				char, err = image.HiresChar(xoffset+col*width, yoffset+row*8)
+			}
+			if err != nil {
+				os.Stderr.WriteString(err.Error())
+			}
+			index, found := indices[string(char)]
+			if !found {
+				index = len(charset.Chars)
+				indices[string(char)] = index
+				charset.Chars = append(charset.Chars, char[0:8])
+				charset.Colors = append(charset.Colors, char[8])
+			}
+			charset.cells[row*cols+col] = index
+			charset.Screen[row*cols+col] = byte(index)
+		}
+	}
+	if len(charset.Chars) > 256 {
+		return &charset, fmt.Errorf("Image needs %d unique chars, which is more than 256", len(charset.Chars))
+	}
+	return &charset, nil
+}
+
+// CharsetOptions are the settings of ConvertCharset. BgColor is a color
+// (0-15) or auto, MultiColors the shared multicolors main,mcol1,mcol2 as
+// expected by SetMultiColors, or auto, and Target the number of chars to
+// reduce the charset to, 0 meaning only when more than 256 are needed.
+type CharsetOptions struct {
+	BgColor     string
+	MultiColors string
+	Target      int
+	EdgeWeight  float64
+}
+
+// ConvertCharset chooses the background color and shared multicolors as
+// given by options, extracts a charset covering cols x rows chars at the
+// given offset and reduces it to the target number of chars, writing a
+// report of the chosen colors, clashes and merged chars to w. An error is
+// returned only for invalid options.
+func (image *Image) ConvertCharset(xoffset, yoffset, cols, rows int, options CharsetOptions, w io.Writer) (*Charset, error) {
+	if image.mcol && options.MultiColors != "auto" {
+		colors, err := ParseColors(options.MultiColors, 3)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkCharFallback(colors[2]); err != nil {
+			return nil, err
+		}
+		image.SetMultiColors(colors[0], colors[1], colors[2])
+	}
+	autoBg := options.BgColor == "auto"
+	if autoBg && (!image.mcol || options.MultiColors != "auto") {
+		scores := image.RankCharBackgrounds(xoffset, yoffset, cols, rows)
+		image.BgColor = scores[0].Colors[0]
+	} else if !autoBg {
+		bg, err := strconv.Atoi(options.BgColor)
+		if err != nil || bg < 0 || bg > 15 {
+			return nil, fmt.Errorf("Invalid background color %q", options.BgColor)
+		}
+		image.BgColor = byte(bg)
+	}
+	if image.mcol && options.MultiColors == "auto" {
+		score := image.ChooseMultiColors(xoffset, yoffset, cols, rows, autoBg)
+		fmt.Fprintf(w, "Multicolors %v: %4d clashes, error %.1f\n", score.Colors, score.Clashes, score.Error)
+	}
+
+	charset, err := image.Charset(xoffset, yoffset, cols, rows)
+
+	if image.Resolve {
+		image.WriteClashReport(w)
+	}
+
+	target := options.Target
+	if err != nil || (target > 0 && len(charset.Chars) > target) {
+		if err != nil {
+			fmt.Fprintln(w, err)
+		}
+		if target <= 0 || target > 256 {
+			target = 256
+		}
+		changes := image.ReduceCharset(charset, target, options.EdgeWeight)
+		WriteCharChangeReport(w, changes)
+	}
+	fmt.Fprintf(w, "%d unique chars for %dx%d screen\n", len(charset.Chars), cols, rows)
+	return charset, nil
+}
+
+// ReduceCharset merges similar chars of a charset until at most target
+// chars remain, each time replacing the char that costs the least error
+// summed over all its uses. Pixels on edges within either char weigh
+// 1+edgeWeight times as much as other pixels. The changed screen cells
+// are returned in screen order.
+func (image *Image) ReduceCharset(charset *Charset, target int, edgeWeight float64) []CharChange {
+	n := len(charset.Chars)
+	table := image.distanceTable()
+	pixels := make([][][]byte, n)
+	edges := make([][][]bool, n)
+	for i := range pixels {
+		pixels[i] = charset.CharPixels(i)
+		edges[i] = charEdges(pixels[i])
+	}
+	cost := func(a, b int) float64 {
+		sum := 0.0
+		for y := range pixels[a] {
+			for x := range pixels[a][y] {
+				d := table[pixels[a][y][x]][pixels[b][y][x]]
+				if edges[a][y][x] || edges[b][y][x] {
+					d *= 1 + edgeWeight
+				}
+				sum += d
+			}
+		}
+		return sum
+	}
+
+	final := mergeChars(charset.cells, n, target, cost)
+
+	// Renumber the remaining chars
+	numbers := make([]int, n)
+	chars := [][]byte{}
+	colors := []byte{}
+	for i := 0; i < n; i++ {
+		if final[i] == i {
+			numbers[i] = len(chars)
+			chars = append(chars, charset.Chars[i])
+			colors = append(colors, charset.Colors[i])
+		}
+	}
+	width := 8
+	if charset.Multicolor {
+		width = 4
+	}
+	changes := []CharChange{}
+	for offset, index := range charset.cells {
+		to := final[index]
+		if to != index {
+			changes = append(changes, CharChange{
+				X:     charset.xoffset + (offset%charset.Width)*width,
+				Y:     charset.yoffset + (offset/charset.Width)*8,
+				From:  index,
+				To:    numbers[to],
+				Error: cost(index, to)})
+		}
+		charset.cells[offset] = numbers[to]
+		charset.Screen[offset] = byte(numbers[to])
+	}
+	charset.Chars = chars
+	charset.Colors = colors
+	return changes
+}
+
+// mergeChars merges the n chars used by the given cells until at most
+// target chars remain, each time replacing the char that costs the least
+// summed over all its uses by the char nearest to it, and returns the
+// remaining char each char ends up replaced by. Chars are never merged
+// at an infinite cost, so more than target chars may remain.
+func mergeChars(cells []int, n, target int, cost func(a, b int) float64) []int {
+	uses := make([]int, n)
+	for _, index := range cells {
+		uses[index]++
+	}
+	alive := make([]bool, n)
+	for i := range alive {
+		alive[i] = true
+	}
+	// nearest[i] is the remaining char closest to char i
+	nearest := make([]int, n)
+	distances := make([]float64, n)
+	findNearest := func(i int) {
+		nearest[i] = -1
+		for j := 0; j < n; j++ {
+			if j != i && alive[j] {
+				d := cost(i, j)
+				if !math.IsInf(d, 1) && (nearest[i] < 0 || d < distances[i]) {
+					nearest[i], distances[i] = j, d
+				}
+			}
+		}
+	}
+	for i := 0; i < n; i++ {
+		findNearest(i)
+	}
+
+	replaced := make([]int, n)
+	for i := range replaced {
+		replaced[i] = i
+	}
+	for count := n; count > target && count > 1; count-- {
+		best := -1
+		for i := 0; i < n; i++ {
+			if alive[i] && nearest[i] >= 0 && (best < 0 || distances[i]*float64(uses[i]) < distances[best]*float64(uses[best])) {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+		into := nearest[best]
+		alive[best] = false
+		replaced[best] = into
+		uses[into] += uses[best]
+		for i := 0; i < n; i++ {
+			if alive[i] && nearest[i] == best {
+				findNearest(i)
+			}
+		}
+	}
+
+	// Follow chains of replacements
+	final := make([]int, n)
+	for i := range final {
+		final[i] = i
+		for replaced[final[i]] != final[i] {
+			final[i] = replaced[final[i]]
+		}
+	}
+	return final
+}
+
+// WriteCharChangeReport writes a line for each changed screen cell,
+// followed by the total error
+func WriteCharChangeReport(w io.Writer, changes []CharChange) {
+	total := 0.0
+	for _, change := range changes {
+		fmt.Fprintf(w, "Replaced char in cell at x=%3d, y=%3d: %4d -> %3d, error %.1f\n",
+			change.X, change.Y, change.From, change.To, change.Error)
+		total += change.Error
+	}
+	fmt.Fprintf(w, "%d cells changed, total error %.1f\n", len(changes), total)
+}
+
+// charEdges marks the pixels of a char that differ from a neighbor
+func charEdges(pixels [][]byte) [][]bool {
+	edges := make([][]bool, len(pixels))
+	for y := range pixels {
+		edges[y] = make([]bool, len(pixels[y]))
+		for x := range pixels[y] {
+			edges[y][x] = (x > 0 && pixels[y][x-1] != pixels[y][x]) ||
+				(x+1 < len(pixels[y]) && pixels[y][x+1] != pixels[y][x]) ||
+				(y > 0 && pixels[y-1][x] != pixels[y][x]) ||
+				(y+1 < len(pixels) && pixels[y+1][x] != pixels[y][x])
+		}
+	}
+	return edges
+}
@@ -0,0 +1,183 @@
+package gfx
+
+import (
+	"image/color"
+	"log"
+	"math"
+)
+
+// ColorDistance returns a measure of how different two colors are,
+// where 0 means that they are identical
+type ColorDistance func(a, b color.Color) float64
+
+var DistanceMap = map[string]ColorDistance{
+	"rgb":     RGBDistance,
+	"redmean": RedmeanDistance,
+	"lab":     LabDistance,
+	"de2000":  CIEDE2000Distance,
+}
+
+// DistanceByName returns the color distance metric with the given name
+func DistanceByName(name string) ColorDistance {
+	distance, ok := DistanceMap[name]
+	if !ok {
+		log.Printf("Invalid distance metric %q, defaulting to %q.\n", name, "redmean")
+		return RedmeanDistance
+	}
+	return distance
+}
+
+// RGBDistance is the euclidean distance between two colors in RGB space
+func RGBDistance(a, b color.Color) float64 {
+	r1, g1, b1 := rgb(a)
+	r2, g2, b2 := rgb(b)
+	return math.Sqrt((r1-r2)*(r1-r2) + (g1-g2)*(g1-g2) + (b1-b2)*(b1-b2))
+}
+
+// RedmeanDistance is the RGB distance weighted by the mean red level,
+// a cheap approximation of perceived difference
+func RedmeanDistance(a, b color.Color) float64 {
+	r1, g1, b1 := rgb(a)
+	r2, g2, b2 := rgb(b)
+	rm := (r1 + r2) / 2
+	dr, dg, db := r1-r2, g1-g2, b1-b2
+	return math.Sqrt((2+rm/256)*dr*dr + 4*dg*dg + (2+(255-rm)/256)*db*db)
+}
+
+// LabDistance is the euclidean distance between two colors in CIELAB
+// space (CIE76)
+func LabDistance(a, b color.Color) float64 {
+	l1, a1, b1 := lab(a)
+	l2, a2, b2 := lab(b)
+	return math.Sqrt((l1-l2)*(l1-l2) + (a1-a2)*(a1-a2) + (b1-b2)*(b1-b2))
+}
+
+// CIEDE2000Distance is the CIEDE2000 color difference between two
+// colors, which corrects CIELAB distance for perceptual non-uniformities
+func CIEDE2000Distance(a, b color.Color) float64 {
+	l1, a1, b1 := lab(a)
+	l2, a2, b2 := lab(b)
+	return ciede2000(l1, a1, b1, l2, a2, b2)
+}
+
+// ciede2000 returns the CIEDE2000 color difference between two CIELAB
+// colors, with all parametric weighting factors 1
+func ciede2000(l1, a1, b1, l2, a2, b2 float64) float64 {
+	c1, c2 := math.Hypot(a1, b1), math.Hypot(a2, b2)
+	cm := math.Pow((c1+c2)/2, 7)
+	g := 0.5 * (1 - math.Sqrt(cm/(cm+math.Pow(25, 7))))
+	a1, a2 = a1*(1+g), a2*(1+g)
+	c1, c2 = math.Hypot(a1, b1), math.Hypot(a2, b2)
+	h1, h2 := hueAngle(a1, b1), hueAngle(a2, b2)
+
+	dl, dc := l2-l1, c2-c1
+	dh := 0.0
+	if c1*c2 != 0 {
+		dh = h2 - h1
+		if dh > 180 {
+			dh -= 360
+		} else if dh < -180 {
+			dh += 360
+		}
+	}
+	dhh := 2 * math.Sqrt(c1*c2) * math.Sin(radians(dh/2))
+
+	lm, cm := (l1+l2)/2, (c1+c2)/2
+	hm := h1 + h2
+	if c1*c2 != 0 {
+		if math.Abs(h1-h2) <= 180 {
+			hm /= 2
+		} else if h1+h2 < 360 {
+			hm = (hm + 360) / 2
+		} else {
+			hm = (hm - 360) / 2
+		}
+	}
+	t := 1 - 0.17*math.Cos(radians(hm-30)) + 0.24*math.Cos(radians(2*hm)) +
+		0.32*math.Cos(radians(3*hm+6)) - 0.20*math.Cos(radians(4*hm-63))
+	sl := 1 + 0.015*(lm-50)*(lm-50)/math.Sqrt(20+(lm-50)*(lm-50))
+	sc := 1 + 0.045*cm
+	sh := 1 + 0.015*cm*t
+	cm7 := math.Pow(cm, 7)
+	rt := -2 * math.Sqrt(cm7/(cm7+math.Pow(25, 7))) *
+		math.Sin(radians(60*math.Exp(-((hm-275)/25)*((hm-275)/25))))
+	return math.Sqrt((dl/sl)*(dl/sl) + (dc/sc)*(dc/sc) + (dhh/sh)*(dhh/sh) + rt*(dc/sc)*(dhh/sh))
+}
+
+// hueAngle returns the hue angle in degrees, 0-360
+func hueAngle(a, b float64) float64 {
+	if a == 0 && b == 0 {
+		return 0
+	}
+	h := math.Atan2(b, a) * 180 / math.Pi
+	if h < 0 {
+		h += 360
+	}
+	return h
+}
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+// nearestColor returns the index of the color in colors closest to c,
+// along with the distance between them
+func nearestColor(c color.Color, colors []color.Color, distance ColorDistance) (byte, float64) {
+	best, bestDistance := 0, math.Inf(1)
+	for i, pc := range colors {
+		d := distance(c, pc)
+		if d < bestDistance {
+			best, bestDistance = i, d
+		}
+	}
+	return byte(best), bestDistance
+}
+
+// mixColors returns the average of two colors in linear light
+func mixColors(a, b color.Color) color.Color {
+	r1, g1, b1 := rgb(a)
+	r2, g2, b2 := rgb(b)
+	mix := func(v1, v2 float64) float64 {
+		return 255 * gamma((linear(v1/255)+linear(v2/255))/2)
+	}
+	return rgbColor([3]float64{mix(r1, r2), mix(g1, g2), mix(b1, b2)})
+}
+
+// rgb returns the 8-bit red, green and blue components of c
+func rgb(c color.Color) (float64, float64, float64) {
+	r, g, b, _ := c.RGBA()
+	return float64(r >> 8), float64(g >> 8), float64(b >> 8)
+}
+
+// lab converts c from sRGB to CIELAB using the D65 white point
+func lab(c color.Color) (float64, float64, float64) {
+	r, g, b := rgb(c)
+	r, g, b = linear(r/255), linear(g/255), linear(b/255)
+	x := (0.4124*r + 0.3576*g + 0.1805*b) / 0.95047
+	y := 0.2126*r + 0.7152*g + 0.0722*b
+	z := (0.0193*r + 0.1192*g + 0.9505*b) / 1.08883
+	fx, fy, fz := labF(x), labF(y), labF(z)
+	return 116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)
+}
+
+func linear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// gamma is the inverse of linear
+func gamma(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+func labF(t float64) float64 {
+	if t > 216.0/24389.0 {
+		return math.Cbrt(t)
+	}
+	return (24389.0/27.0*t + 16) / 116
+}
@@ -0,0 +1,145 @@
+package gfx
+
+import (
+	img "image"
+	"image/color"
+	"math"
+)
+
+// PALPixelAspect is the width of a VIC-II pixel on a PAL screen relative
+// to its height
+const PALPixelAspect = 0.9365
+
+// CRTParams control how a rendered image is made to look like it does on
+// a PAL monitor. Scale is the number of output rows per source line,
+// Aspect the pixel aspect ratio, ChromaBleed and LumaBlur the horizontal
+// blur in pixels of the color and brightness signals, DelayLine whether
+// the color of each line is blended with the line above, as the PAL delay
+// line does, and Scanlines how much the gaps between lines are darkened,
+// from 0 to 1.
+type CRTParams struct {
+	Scale       int
+	Aspect      float64
+	ChromaBleed float64
+	LumaBlur    float64
+	DelayLine   bool
+	Scanlines   float64
+}
+
+// DefaultCRTParams resemble a typical PAL monitor
+var DefaultCRTParams = CRTParams{
+	Scale:       3,
+	Aspect:      PALPixelAspect,
+	ChromaBleed: 2.5,
+	LumaBlur:    0.5,
+	DelayLine:   true,
+	Scanlines:   0.4,
+}
+
+// CRTImage returns a preview of a rendered image as a PAL monitor would
+// show it, scaled by params.Scale vertically and params.Scale times the
+// pixel aspect ratio horizontally
+func CRTImage(source img.Image, params CRTParams) *img.RGBA {
+	bounds := source.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if params.Scale < 1 {
+		params.Scale = 1
+	}
+
+	ys := make([][]float64, height)
+	us := make([][]float64, height)
+	vs := make([][]float64, height)
+	for y := 0; y < height; y++ {
+		ys[y], us[y], vs[y] = make([]float64, width), make([]float64, width), make([]float64, width)
+		for x := 0; x < width; x++ {
+			r, g, b := rgb(source.At(bounds.Min.X+x, bounds.Min.Y+y))
+			ys[y][x] = 0.299*r + 0.587*g + 0.114*b
+			us[y][x] = 0.492 * (b - ys[y][x])
+			vs[y][x] = 0.877 * (r - ys[y][x])
+		}
+		ys[y] = blurRow(ys[y], params.LumaBlur)
+		us[y] = blurRow(us[y], params.ChromaBleed)
+		vs[y] = blurRow(vs[y], params.ChromaBleed)
+	}
+	if params.DelayLine {
+		for y := height - 1; y > 0; y-- {
+			for x := 0; x < width; x++ {
+				us[y][x] = (us[y][x] + us[y-1][x]) / 2
+				vs[y][x] = (vs[y][x] + vs[y-1][x]) / 2
+			}
+		}
+	}
+
+	scale := float64(params.Scale)
+	xscale := scale * params.Aspect
+	outWidth := int(math.Round(float64(width) * xscale))
+	rendered := img.NewRGBA(img.Rect(0, 0, outWidth, height*params.Scale))
+	for y := 0; y < height; y++ {
+		for row := 0; row < params.Scale; row++ {
+			level := 1.0
+			if params.Scale > 1 {
+				d := (float64(row) + 0.5 - scale/2) / (scale / 2)
+				level = 1 - params.Scanlines*d*d
+			}
+			for x := 0; x < outWidth; x++ {
+				sx := (float64(x)+0.5)/xscale - 0.5
+				luma := sampleRow(ys[y], sx) * level
+				u := sampleRow(us[y], sx) * level
+				v := sampleRow(vs[y], sx) * level
+				rendered.Set(x, y*params.Scale+row, color.RGBA{
+					clampByte(luma + 1.140*v),
+					clampByte(luma - 0.396*u - 0.581*v),
+					clampByte(luma + 2.029*u),
+					255,
+				})
+			}
+		}
+	}
+	return rendered
+}
+
+// blurRow returns a row of values blurred with a gaussian kernel of the
+// given standard deviation, repeating the edge values
+func blurRow(row []float64, sigma float64) []float64 {
+	if sigma <= 0 {
+		return row
+	}
+	radius := int(math.Ceil(3 * sigma))
+	kernel := make([]float64, 2*radius+1)
+	sum := 0.0
+	for i := range kernel {
+		d := float64(i - radius)
+		kernel[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	blurred := make([]float64, len(row))
+	for x := range row {
+		for i, k := range kernel {
+			sx := x + i - radius
+			if sx < 0 {
+				sx = 0
+			} else if sx >= len(row) {
+				sx = len(row) - 1
+			}
+			blurred[x] += row[sx] * k / sum
+		}
+	}
+	return blurred
+}
+
+// sampleRow returns the linearly interpolated value at position x
+func sampleRow(row []float64, x float64) float64 {
+	if x <= 0 {
+		return row[0]
+	}
+	i := int(x)
+	if i >= len(row)-1 {
+		return row[len(row)-1]
+	}
+	f := x - float64(i)
+	return row[i]*(1-f) + row[i+1]*f
+}
+
+func clampByte(value float64) uint8 {
+	return uint8(math.Round(math.Min(math.Max(value, 0), 255)))
+}
@@ -0,0 +1,318 @@
+package gfx
+
+import (
+	img "image"
+	"image/color"
+	"log"
+	"math"
+	"sort"
+)
+
+// Dither selects how source colors that are not in the palette are
+// approximated when converting an Image
+type Dither int
+
+const (
+	NoDither Dither = iota
+	FloydSteinberg
+	Atkinson
+	Sierra
+	Bayer2
+	Bayer4
+	Bayer8
+)
+
+var DitherMap = map[string]Dither{
+	"none":            NoDither,
+	"floyd-steinberg": FloydSteinberg,
+	"atkinson":        Atkinson,
+	"sierra":          Sierra,
+	"bayer2":          Bayer2,
+	"bayer4":          Bayer4,
+	"bayer8":          Bayer8,
+}
+
+// DitherByName returns the dithering method with the given name
+func DitherByName(name string) Dither {
+	dither, ok := DitherMap[name]
+	if !ok {
+		log.Printf("Invalid dithering method %q, defaulting to %q.\n", name, "none")
+		return NoDither
+	}
+	return dither
+}
+
+type diffusion struct {
+	dx, dy int
+	weight float64
+}
+
+var diffusionKernels = map[Dither][]diffusion{
+	FloydSteinberg: {
+		{1, 0, 7.0 / 16}, {-1, 1, 3.0 / 16}, {0, 1, 5.0 / 16}, {1, 1, 1.0 / 16}},
+	Atkinson: {
+		{1, 0, 1.0 / 8}, {2, 0, 1.0 / 8}, {-1, 1, 1.0 / 8},
+		{0, 1, 1.0 / 8}, {1, 1, 1.0 / 8}, {0, 2, 1.0 / 8}},
+	Sierra: {
+		{1, 0, 5.0 / 32}, {2, 0, 3.0 / 32},
+		{-2, 1, 2.0 / 32}, {-1, 1, 4.0 / 32}, {0, 1, 5.0 / 32}, {1, 1, 4.0 / 32}, {2, 1, 2.0 / 32},
+		{-1, 2, 2.0 / 32}, {0, 2, 3.0 / 32}, {1, 2, 2.0 / 32}},
+}
+
+var bayerSizes = map[Dither]int{Bayer2: 2, Bayer4: 4, Bayer8: 8}
+
+// Amount of RGB offset applied by ordered dithering at the extremes of
+// the threshold matrix
+const orderedSpread = 64.0
+
+// dither remaps the pixels in the given area (in the units used by Pixels)
+// from the colors of the source image. For each cell of cellWidth x
+// cellHeight pixels, the colors returned by fixed for the position of the
+// cell within the area and up to free other colors are selected first,
+// then each pixel is set to one of those colors.
+func (image *Image) dither(area img.Rectangle, cellWidth, cellHeight int, fixed func(x, y int) []byte, free int) {
+	if image.Dither == NoDither {
+		return
+	}
+	width, height := area.Dx(), area.Dy()
+	work := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			work[y*width+x] = image.sourceRGB(area.Min.X+x, area.Min.Y+y)
+		}
+	}
+
+	cells := make([][]byte, ((width+cellWidth-1)/cellWidth)*((height+cellHeight-1)/cellHeight))
+	cols := (width + cellWidth - 1) / cellWidth
+	for i := range cells {
+		x, y := (i%cols)*cellWidth, (i/cols)*cellHeight
+		samples := image.sourceSamples(area.Min.X+x, area.Min.Y+y, cellWidth, cellHeight)
+		cells[i] = image.bestColors(samples, fixed(x, y), free, image.candidates(samples, 2))
+	}
+
+	kernel := diffusionKernels[image.Dither]
+	size := bayerSizes[image.Dither]
+	matrix := bayerMatrix(size)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			value := work[y*width+x]
+			for i := range value {
+				value[i] = math.Max(0, math.Min(255, value[i]))
+			}
+			target := value
+			if size > 0 {
+				offset := (matrix[(y%size)*size+x%size] - 0.5) * orderedSpread
+				for i := range target {
+					target[i] += offset
+				}
+			}
+			colors := cells[(y/cellHeight)*cols+x/cellWidth]
+			c := colors[0]
+			if len(colors) > 1 {
+				index, _ := nearestColor(rgbColor(target), image.paletteColors(colors), image.distance)
+				c = colors[index]
+			}
+			image.setPixel(area.Min.X+x, area.Min.Y+y, c)
+
+			r, g, b := rgb(image.palette[c])
+			diff := [3]float64{value[0] - r, value[1] - g, value[2] - b}
+			for _, d := range kernel {
+				xx, yy := x+d.dx, y+d.dy
+				if xx < 0 || xx >= width || yy >= height {
+					continue
+				}
+				for i := range diff {
+					work[yy*width+xx][i] += diff[i] * d.weight
+				}
+			}
+		}
+	}
+}
+
+// bestColors returns the fixed colors followed by up to free colors from
+// candidates, chosen to minimize the total distance from each sample to
+// its nearest chosen color
+func (image *Image) bestColors(samples []color.Color, fixed []byte, free int, candidates []byte) []byte {
+	options := []byte{}
+	for _, c := range candidates {
+		if !containsColor(fixed, c) {
+			options = append(options, c)
+		}
+	}
+	if len(options) <= free {
+		return append(append([]byte{}, fixed...), options...)
+	}
+
+	distances := make([][]float64, len(samples))
+	for i, s := range samples {
+		distances[i] = make([]float64, len(image.palette))
+		for c, pc := range image.palette {
+			distances[i][c] = image.distance(s, pc)
+		}
+	}
+	cost := func(colors []byte) float64 {
+		total := 0.0
+		for i := range samples {
+			best := math.Inf(1)
+			for _, c := range colors {
+				best = math.Min(best, distances[i][c])
+			}
+			total += best
+		}
+		return total
+	}
+
+	var best []byte
+	bestCost := math.Inf(1)
+	combinations(len(options), free, func(chosen []byte) {
+		colors := append([]byte{}, fixed...)
+		for _, i := range chosen {
+			colors = append(colors, options[i])
+		}
+		if total := cost(colors); total < bestCost {
+			best, bestCost = colors, total
+		}
+	})
+	return best
+}
+
+// candidates returns the palette colors that are among the n nearest to
+// any of the samples, in ascending order
+func (image *Image) candidates(samples []color.Color, n int) []byte {
+	found := map[byte]bool{}
+	for _, s := range samples {
+		order := make([]int, len(image.palette))
+		distances := make([]float64, len(image.palette))
+		for i, pc := range image.palette {
+			order[i], distances[i] = i, image.distance(s, pc)
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return distances[order[i]] < distances[order[j]]
+		})
+		for _, c := range order[:n] {
+			found[byte(c)] = true
+		}
+	}
+	colors := []byte{}
+	for c := 0; c < len(image.palette); c++ {
+		if found[byte(c)] {
+			colors = append(colors, byte(c))
+		}
+	}
+	return colors
+}
+
+// sourceRGB returns the source color at the given position in the units
+// used by Pixels, averaging both source pixels for multicolor images
+func (image *Image) sourceRGB(x, y int) [3]float64 {
+	points := []img.Point{{x, y}}
+	if image.mcol {
+		points = []img.Point{{x * 2, y}, {x*2 + 1, y}}
+	}
+	var sum [3]float64
+	for _, p := range points {
+		var c color.Color = image.palette[image.BgColor]
+		if p.In(image.img.Bounds()) {
+			c = image.img.At(p.X, p.Y)
+		}
+		r, g, b := rgb(c)
+		sum[0], sum[1], sum[2] = sum[0]+r, sum[1]+g, sum[2]+b
+	}
+	for i := range sum {
+		sum[i] /= float64(len(points))
+	}
+	return sum
+}
+
+// sourceSamples returns the source colors of the given area in the units
+// used by Pixels, row by row
+func (image *Image) sourceSamples(xoffset, yoffset, width, height int) []color.Color {
+	samples := []color.Color{}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			samples = append(samples, rgbColor(image.sourceRGB(xoffset+x, yoffset+y)))
+		}
+	}
+	return samples
+}
+
+// hiresSamples returns the source colors of the given area of a
+// multicolor image, given in the units used by Pixels, one source pixel
+// at a time, so that each row has twice width samples
+func (image *Image) hiresSamples(xoffset, yoffset, width, height int) []color.Color {
+	samples := []color.Color{}
+	for y := yoffset; y < yoffset+height; y++ {
+		for x := xoffset * 2; x < (xoffset+width)*2; x++ {
+			var c color.Color = image.palette[image.BgColor]
+			if img.Pt(x, y).In(image.img.Bounds()) {
+				c = image.img.At(x, y)
+			}
+			samples = append(samples, c)
+		}
+	}
+	return samples
+}
+
+// setPixel sets the color of the pixel at the given position in the units
+// used by Pixels
+func (image *Image) setPixel(x, y int, c byte) {
+	xs := []int{x}
+	if image.mcol {
+		xs = []int{x * 2, x*2 + 1}
+	}
+	for _, xx := range xs {
+		if i := image.pixelIndex(xx, y); i >= 0 {
+			image.pixels[i] = c
+		}
+	}
+}
+
+func (image *Image) paletteColors(indices []byte) []color.Color {
+	colors := make([]color.Color, len(indices))
+	for i, c := range indices {
+		colors[i] = image.palette[c]
+	}
+	return colors
+}
+
+// bayerMatrix returns the n x n Bayer threshold matrix, normalized to 0-1
+func bayerMatrix(n int) []float64 {
+	if n < 2 {
+		return nil
+	}
+	m := []int{0}
+	for size := 1; size < n; size *= 2 {
+		next := make([]int, size*size*4)
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				v := m[y*size+x] * 4
+				next[y*size*2+x] = v
+				next[y*size*2+x+size] = v + 2
+				next[(y+size)*size*2+x] = v + 3
+				next[(y+size)*size*2+x+size] = v + 1
+			}
+		}
+		m = next
+	}
+	matrix := make([]float64, n*n)
+	for i, v := range m {
+		matrix[i] = (float64(v) + 0.5) / float64(n*n)
+	}
+	return matrix
+}
+
+func rgbColor(v [3]float64) color.Color {
+	clamp := func(f float64) uint8 {
+		return uint8(math.Max(0, math.Min(255, math.Round(f))))
+	}
+	return color.RGBA{clamp(v[0]), clamp(v[1]), clamp(v[2]), 255}
+}
+
+func containsColor(colors []byte, c byte) bool {
+	for _, cc := range colors {
+		if cc == c {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,224 @@
+package gfx
+
+import (
+	"bytes"
+	"fmt"
+	img "image"
+	"io"
+	"os"
+)
+
+// Sizes of FLI data without load address
+const (
+	fliGraphSize    = 17472
+	fliDesignerSize = 17216
+)
+
+// FLI represents a full-screen multicolor FLI image, which has a separate
+// screen for each of the 8 pixel rows of a char row
+type FLI struct {
+	Bitmap  []byte
+	Screens [][]byte
+	Colmap  []byte
+	BgColor byte
+}
+
+// Bytes returns FLI data in FLI Graph layout, to be loaded at $3B00: a
+// background color for each raster line, padded to 256 bytes, followed
+// by the color map and the 8 screens, each aligned to 1024 bytes, and
+// finally the bitmap.
+func (fli *FLI) Bytes() []byte {
+	segments := [][]byte{
+		bytes.Repeat([]byte{fli.BgColor}, 200), make([]byte, 56),
+		fli.Colmap, make([]byte, 24),
+	}
+	for _, screen := range fli.Screens {
+		segments = append(segments, screen, make([]byte, 24))
+	}
+	segments = append(segments, fli.Bitmap)
+	return bytes.Join(segments, []byte{})
+}
+
+// ColorAt returns the color index of the multicolor pixel at x (0-159), y (0-199)
+func (fli *FLI) ColorAt(x, y int) byte {
+	offset := (y/8)*40 + x/4
+	value := fli.Bitmap[(y/8)*320+(x/4)*8+y%8]
+	switch (value >> uint(6-(x%4)*2)) & 3 {
+	case 1:
+		return fli.Screens[y%8][offset] >> 4
+	case 2:
+		return fli.Screens[y%8][offset] & 0x0F
+	case 3:
+		return fli.Colmap[offset] & 0x0F
+	}
+	return fli.BgColor & 0x0F
+}
+
+// Render returns the FLI image as a 320x200 paletted image using the
+// given palette, with each multicolor pixel two pixels wide
+func (fli *FLI) Render(palette *Palette) *img.Paletted {
+	rendered := img.NewPaletted(img.Rect(0, 0, 320, 200), palette.Colors)
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 160; x++ {
+			c := fli.ColorAt(x, y)
+			rendered.SetColorIndex(x*2, y, c)
+			rendered.SetColorIndex(x*2+1, y, c)
+		}
+	}
+	return rendered
+}
+
+// ParseFLI reads FLI data in FLI Graph layout as produced by Bytes, or
+// in FLI Designer layout which lacks the background colors and starts
+// with the color map at $3C00, with or without load address.
+func ParseFLI(r io.Reader) (*FLI, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	switch len(data) {
+	case fliGraphSize + 2, fliDesignerSize + 2:
+		data = data[2:]
+	}
+	fli := FLI{
+		Bitmap:  make([]byte, 8000),
+		Screens: make([][]byte, 8),
+		Colmap:  make([]byte, 1000)}
+	switch len(data) {
+	case fliGraphSize:
+		fli.BgColor = data[0] & 0x0F
+		data = data[256:]
+	case fliDesignerSize:
+	default:
+		return nil, fmt.Errorf("Unexpected size of FLI data: %d bytes", len(data))
+	}
+	copy(fli.Colmap, data)
+	for i := range fli.Screens {
+		fli.Screens[i] = make([]byte, 1000)
+		copy(fli.Screens[i], data[1024*(i+1):])
+	}
+	copy(fli.Bitmap, data[9216:])
+	return &fli, nil
+}
+
+// FLICell extracts a 4x8 pixels multicolor FLI cell as a 17-byte array,
+// the first 8 bytes are bitmap data, followed by a screen byte for each
+// pixel row and a colmap byte. Colors are limited per 4x1 pixel row,
+// except that the color map is shared by all rows of the cell.
+func (image *Image) FLICell(xoffset, yoffset int) ([]byte, error) {
+	cell := make([]byte, 17)
+	pixels := image.Pixels(xoffset, yoffset, 4, 8)
+	ram := image.fliColorRAM(pixels)
+	var err error
+	for y := 0; y < 8; y++ {
+		row := pixels[y : y+1]
+		colors := colorsUsed(row, image.BgColor)
+		screen := []byte{}
+		for _, c := range colors[1:] {
+			if c != ram {
+				screen = append(screen, c)
+			}
+		}
+		if len(screen) > 2 && image.Resolve {
+			screen = image.resolveClash(xoffset, yoffset+y, row, colors, []byte{image.BgColor, ram}, 2)[2:]
+		}
+		slots := image.assignSlots(screen, []int{SlotScreenHigh, SlotScreenLow})
+		bits := []byte{image.BgColor, slots[SlotScreenHigh], slots[SlotScreenLow], ram}
+		for x := 0; x < 4; x++ {
+			cell[y] = (cell[y] << 2) + bitsOf(bits, row[0][x])
+		}
+		cell[8+y] = slots[SlotScreenHigh]*16 + slots[SlotScreenLow]
+		if len(screen) > 2 {
+			image.AddClash(xoffset, yoffset+y, colors)
+			err = fmt.Errorf("Too many colors in cell at x=%3d, y=%3d: %v\n", xoffset, yoffset+y, colors)
+		}
+	}
+	cell[16] = ram
+	return cell, err
+}
+
+// fliColorRAM picks the color map color of a FLI cell. A color locked to
+// the color RAM slot is always picked if the cell uses it, so that it is
+// never left to the screens. Otherwise it is the color that leaves the
+// most rows with at most two other colors besides the background color.
+func (image *Image) fliColorRAM(pixels [][]byte) byte {
+	if c, locked := image.lockedColorRAM(pixels); locked {
+		return c
+	}
+	counts := histogram(pixels)
+	best, bestRows, bestCount := image.slotFiller(SlotColorRAM), -1, 0
+	for c := 0; c < len(image.palette); c++ {
+		if byte(c) == image.BgColor || counts[byte(c)] == 0 {
+			continue
+		}
+		rows := 0
+		for y := range pixels {
+			colors := colorsUsed(pixels[y:y+1], image.BgColor)
+			if len(colors) <= 3 || (len(colors) == 4 && containsColor(colors, byte(c))) {
+				rows++
+			}
+		}
+		if rows > bestRows || (rows == bestRows && counts[byte(c)] > bestCount) {
+			best, bestRows, bestCount = c, rows, counts[byte(c)]
+		}
+	}
+	return byte(best)
+}
+
+// lockedColorRAM returns the color locked to the color RAM slot that is
+// used by the most pixels of a cell, if the cell uses any
+func (image *Image) lockedColorRAM(pixels [][]byte) (byte, bool) {
+	counts := histogram(pixels)
+	best, found := byte(0), false
+	for c, n := range counts {
+		if slot, forced := image.slots[c]; !forced || slot != SlotColorRAM || c == image.BgColor {
+			continue
+		}
+		if !found || n > counts[best] || (n == counts[best] && c < best) {
+			best, found = c, true
+		}
+	}
+	return best, found
+}
+
+// FLI extracts a full-screen 160x200 multicolor image in FLI format. The
+// leftmost bugColumns char columns, which are hidden by the FLI bug, are
+// left blank.
+func (image *Image) FLI(xoffset, yoffset, bugColumns int) *FLI {
+	fli := FLI{
+		Bitmap:  make([]byte, 8000),
+		Screens: make([][]byte, 8),
+		Colmap:  make([]byte, 1000),
+		BgColor: image.BgColor}
+	for i := range fli.Screens {
+		fli.Screens[i] = make([]byte, 1000)
+	}
+	rams := map[img.Point][]byte{}
+	image.dither(img.Rect(xoffset, yoffset, xoffset+160, yoffset+200), 4, 1, func(x, y int) []byte {
+		cell := img.Point{x, y - y%8}
+		if _, found := rams[cell]; !found {
+			pixels := image.Pixels(xoffset+cell.X, yoffset+cell.Y, 4, 8)
+			if c, locked := image.lockedColorRAM(pixels); locked {
+				rams[cell] = []byte{image.BgColor, c}
+			} else {
+				samples := image.sourceSamples(xoffset+cell.X, yoffset+cell.Y, 4, 8)
+				rams[cell] = image.bestColors(samples, []byte{image.BgColor}, 1, image.candidates(samples, 2))
+			}
+		}
+		return rams[cell]
+	}, 2)
+	for row := 0; row < 25; row++ {
+		for col := bugColumns; col < 40; col++ {
+			cell, err := image.FLICell(xoffset+col*4, yoffset+row*8)
+			if err != nil {
+				os.Stderr.WriteString(err.Error())
+			}
+			copy(fli.Bitmap[row*320+col*8:], cell[0:8])
+			for y := 0; y < 8; y++ {
+				fli.Screens[y][row*40+col] = cell[8+y]
+			}
+			fli.Colmap[row*40+col] = cell[16]
+		}
+	}
+	return &fli
+}
@@ -0,0 +1,55 @@
+package gfx
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// randomFLI returns an FLI image of pseudo-random data
+func randomFLI(rng *rand.Rand) *FLI {
+	fli := &FLI{
+		Bitmap:  randomBytes(rng, 8000, 256),
+		Screens: make([][]byte, 8),
+		Colmap:  randomBytes(rng, 1000, 16),
+		BgColor: 11}
+	for i := range fli.Screens {
+		fli.Screens[i] = randomBytes(rng, 1000, 256)
+	}
+	return fli
+}
+
+func TestFLIRoundTrip(t *testing.T) {
+	fli := randomFLI(rand.New(rand.NewSource(4)))
+	data := fli.Bytes()
+	if len(data) != fliGraphSize {
+		t.Fatalf("got %d bytes, want %d", len(data), fliGraphSize)
+	}
+	for _, file := range [][]byte{data, withLoadAddress(0x3B00, data)} {
+		parsed, err := ParseFLI(bytes.NewReader(file))
+		if err != nil {
+			t.Errorf("%d bytes: %v", len(file), err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed, fli) {
+			t.Errorf("%d bytes: parsed image differs", len(file))
+		}
+		if !bytes.Equal(parsed.Bytes(), data) {
+			t.Errorf("%d bytes: bytes differ after round trip", len(file))
+		}
+	}
+}
+
+func TestParseFLIDesigner(t *testing.T) {
+	fli := randomFLI(rand.New(rand.NewSource(5)))
+	data := fli.Bytes()[256:]
+	parsed, err := ParseFLI(bytes.NewReader(withLoadAddress(0x3C00, data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fli.BgColor = 0
+	if !reflect.DeepEqual(parsed, fli) {
+		t.Error("parsed image differs")
+	}
+}
@@ -1,6 +1,19 @@
 package gfx
 
-import "bytes"
+import (
+	"bytes"
+	"fmt"
+	img "image"
+	"io"
+)
+
+// Sizes of Hires data without load address
+const (
+	hiresSize     = 9000
+	hiresAligned  = 9216
+	hiresTrimmed  = 9192 // aligned without padding after the screen
+	artStudioSize = 9007
+)
 
 // Hires represents a full-screen image in Hires format
 type Hires struct {
@@ -21,3 +34,52 @@ func (hires *Hires) Bytes(align bool) []byte {
 			hires.Bitmap, hires.Screen}, []byte{})
 	}
 }
+
+// ColorAt returns the color index of the pixel at x (0-319), y (0-199)
+func (hires *Hires) ColorAt(x, y int) byte {
+	scr := hires.Screen[(y/8)*40+x/8]
+	if hires.Bitmap[(y/8)*320+(x/8)*8+y%8]&(0x80>>uint(x%8)) != 0 {
+		return scr >> 4
+	}
+	return scr & 0x0F
+}
+
+// Render returns the Hires image as a 320x200 paletted image using the
+// given palette
+func (hires *Hires) Render(palette *Palette) *img.Paletted {
+	rendered := img.NewPaletted(img.Rect(0, 0, 320, 200), palette.Colors)
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 320; x++ {
+			rendered.SetColorIndex(x, y, hires.ColorAt(x, y))
+		}
+	}
+	return rendered
+}
+
+// ParseHires reads Hires data in either of the layouts produced by Bytes,
+// or an Art Studio file, with or without load address. Aligned data may
+// also lack the padding after the screen.
+func ParseHires(r io.Reader) (*Hires, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	switch len(data) {
+	case hiresSize + 2, hiresAligned + 2, hiresTrimmed + 2, artStudioSize + 2:
+		data = data[2:]
+	}
+	screen := 8000
+	switch len(data) {
+	case hiresSize, artStudioSize:
+	case hiresAligned, hiresTrimmed:
+		screen = 8192
+	default:
+		return nil, fmt.Errorf("Unexpected size of Hires data: %d bytes", len(data))
+	}
+	hires := Hires{
+		Bitmap: make([]byte, 8000),
+		Screen: make([]byte, 1000)}
+	copy(hires.Bitmap, data)
+	copy(hires.Screen, data[screen:])
+	return &hires, nil
+}
@@ -0,0 +1,53 @@
+package gfx
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestHiresRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	hires := &Hires{
+		Bitmap: randomBytes(rng, 8000, 256),
+		Screen: randomBytes(rng, 1000, 256)}
+	for _, align := range []bool{false, true} {
+		data := hires.Bytes(align)
+		for _, file := range [][]byte{data, withLoadAddress(0x2000, data)} {
+			parsed, err := ParseHires(bytes.NewReader(file))
+			if err != nil {
+				t.Errorf("align=%v, %d bytes: %v", align, len(file), err)
+				continue
+			}
+			if !reflect.DeepEqual(parsed, hires) {
+				t.Errorf("align=%v, %d bytes: parsed image differs", align, len(file))
+			}
+			if !bytes.Equal(parsed.Bytes(align), data) {
+				t.Errorf("align=%v, %d bytes: bytes differ after round trip", align, len(file))
+			}
+		}
+	}
+}
+
+func TestParseHiresVariants(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	hires := &Hires{
+		Bitmap: randomBytes(rng, 8000, 256),
+		Screen: randomBytes(rng, 1000, 256)}
+	trimmed := hires.Bytes(true)[:9192]
+	artStudio := append(hires.Bytes(false), randomBytes(rng, 7, 256)...)
+	for _, file := range [][]byte{trimmed, withLoadAddress(0x2000, trimmed), artStudio, withLoadAddress(0x2000, artStudio)} {
+		parsed, err := ParseHires(bytes.NewReader(file))
+		if err != nil {
+			t.Errorf("%d bytes: %v", len(file), err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed, hires) {
+			t.Errorf("%d bytes: parsed image differs", len(file))
+		}
+	}
+	if _, err := ParseHires(bytes.NewReader(make([]byte, 9100))); err == nil {
+		t.Error("expected error for 9100 bytes")
+	}
+}
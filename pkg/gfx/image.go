@@ -6,32 +6,63 @@ import (
 	"fmt"
 	img "image"
 	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
 	"image/png"
+	"io"
 	"os"
+	"sort"
 )
 
 // Image represents a complete picture converted from a PNG image
 type Image struct {
-	img     *img.Paletted
-	palette []color.Color
-	colors  []byte
-	mcol    bool
-	BgColor byte
-	mColors []byte
-	Clashes []Clash
+	img       img.Image
+	mapped    *Palette
+	palette   []color.Color
+	pixels    []byte
+	deltas    []float64
+	distance  ColorDistance
+	mcol      bool
+	BgColor   byte
+	mColors   []byte
+	Clashes   []Clash
+	MaxError  float64
+	Dither    Dither
+	Resolve   bool
+	KeepSlots bool
+	slots     map[byte]int
+	kept      map[byte]int
+	misses    [2]int
 }
 
+// Clash describes a cell using more colors than allowed. If the clash was
+// resolved, Kept holds the colors left in the cell, and Changed and Error
+// the number of pixels remapped and their total distance from the source.
 type Clash struct {
-	X      int
-	Y      int
-	Colors []byte
+	X       int
+	Y       int
+	Colors  []byte
+	Kept    []byte
+	Changed int
+	Error   float64
+}
+
+// PixelError describes how far the color of a source pixel is from the
+// palette color it was mapped to
+type PixelError struct {
+	X     int
+	Y     int
+	Color byte
+	Error float64
 }
 
 // NewImage reads an image from a PNG file and returns a Image pointer
 func NewImage(filename string, mcol bool, bgColor byte) *Image {
-	img := pngImage(filename)
-	pal := PaletteBestMatch(img.Palette)
-	return &Image{img, pal.Colors, remapIndices(img.Palette, pal.Colors), mcol, bgColor, nil, []Clash{}}
+	source, err := ReadImage(filename)
+	if err != nil {
+		panic(err)
+	}
+	return FromImage(source, mcol, bgColor, nil, nil)
 }
 
 // MulticolorImage reads an image from a PNG file and returns a Image pointer
@@ -44,6 +75,88 @@ func HiresImage(filename string, bgColor byte) *Image {
 	return NewImage(filename, false, bgColor)
 }
 
+// FromImage converts any image to an Image by mapping each pixel to the
+// nearest color of the given palette. If palette is nil, the best matching
+// palette is detected, and if distance is nil, RedmeanDistance is used.
+func FromImage(source img.Image, mcol bool, bgColor byte, palette *Palette, distance ColorDistance) *Image {
+	if distance == nil {
+		distance = RedmeanDistance
+	}
+	if palette == nil {
+		palette = detectPalette(source)
+	}
+	bounds := source.Bounds()
+	image := &Image{
+		img:      source,
+		mapped:   palette,
+		palette:  palette.Colors,
+		pixels:   make([]byte, bounds.Dx()*bounds.Dy()),
+		deltas:   make([]float64, bounds.Dx()*bounds.Dy()),
+		distance: distance,
+		mcol:     mcol,
+		BgColor:  bgColor,
+		Clashes:  []Clash{}}
+
+	paletted, isPaletted := source.(*img.Paletted)
+	var indices []byte
+	if isPaletted {
+		indices = remapIndices(paletted.Palette, palette)
+	}
+	type match struct {
+		index byte
+		delta float64
+	}
+	matches := map[color.RGBA64]match{}
+	i := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.RGBA64Model.Convert(source.At(x, y)).(color.RGBA64)
+			m, found := matches[c]
+			if !found {
+				if isPaletted {
+					m.index = indices[paletted.ColorIndexAt(x, y)]
+					m.delta = distance(c, palette.Colors[m.index])
+				} else {
+					m.index, m.delta = nearestColor(c, palette.Colors, distance)
+				}
+				matches[c] = m
+			}
+			image.pixels[i], image.deltas[i] = m.index, m.delta
+			if m.delta > image.MaxError {
+				image.MaxError = m.delta
+			}
+			i++
+		}
+	}
+	return image
+}
+
+// ReadImage reads an image from a PNG, GIF or JPEG file
+func ReadImage(filename string) (img.Image, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decoded, _, err := img.Decode(file)
+	return decoded, err
+}
+
+// Size returns the width and height of the image in the units used by Pixels
+func (image *Image) Size() (int, int) {
+	bounds := image.img.Bounds()
+	if image.mcol {
+		return bounds.Dx() / 2, bounds.Dy()
+	}
+	return bounds.Dx(), bounds.Dy()
+}
+
+// MappedPalette returns the palette the image colors were mapped to
+func (image *Image) MappedPalette() *Palette {
+	return image.mapped
+}
+
 func (image *Image) Palette() []string {
 	strings := make([]string, len(image.palette))
 	for i, c := range image.palette {
@@ -54,16 +167,59 @@ func (image *Image) Palette() []string {
 }
 
 func (image *Image) PixelAt(x, y int) byte {
-	if (img.Point{x, y}).In(image.img.Rect) {
-		//if x == 28 && y == 152 {
-		//fmt.Printf("cia=%d, colors=%+v\n", image.img.ColorIndexAt(x, y), image.colors)
-		//}
-		return image.colors[image.img.ColorIndexAt(x, y)]
+	if i := image.pixelIndex(x, y); i >= 0 {
+		return image.pixels[i]
 	} else {
 		return image.BgColor
 	}
 }
 
+// WorstPixels returns up to n of the pixels whose source colors are
+// furthest from the palette, worst first
+func (image *Image) WorstPixels(n int) []PixelError {
+	worst := []PixelError{}
+	bounds := image.img.Bounds()
+	for i, delta := range image.deltas {
+		if delta > 0 {
+			worst = append(worst, PixelError{
+				X:     bounds.Min.X + i%bounds.Dx(),
+				Y:     bounds.Min.Y + i/bounds.Dx(),
+				Color: image.pixels[i],
+				Error: delta})
+		}
+	}
+	sort.SliceStable(worst, func(i, j int) bool {
+		return worst[i].Error > worst[j].Error
+	})
+	if len(worst) > n {
+		worst = worst[:n]
+	}
+	return worst
+}
+
+// WriteInexactReport writes up to n of the pixels returned by WorstPixels
+// to w
+func (image *Image) WriteInexactReport(w io.Writer, n int) {
+	for _, p := range image.WorstPixels(n) {
+		fmt.Fprintf(w, "Inexact color at x=%3d, y=%3d mapped to %2d, distance %.1f\n", p.X, p.Y, p.Color, p.Error)
+	}
+}
+
+// MostUsedColor returns the color of most pixels, the lowest one if tied
+func (image *Image) MostUsedColor() byte {
+	counts := make([]int, len(image.palette))
+	for _, c := range image.pixels {
+		counts[c]++
+	}
+	most := 0
+	for c, n := range counts {
+		if n > counts[most] {
+			most = c
+		}
+	}
+	return byte(most)
+}
+
 func (image *Image) HiresByte(x, y, c int) byte {
 	value := byte(0)
 	for i := 0; i < 8; i++ {
@@ -91,43 +247,160 @@ func (image *Image) Pixels(xoffset, yoffset, width, height int) [][]byte {
 	return pix
 }
 
-// MulticolorSprite extracts a multicolor sprite as a 64-byte array
+// MulticolorSprite extracts a multicolor sprite as a 64-byte array, with
+// the colors for bit pairs 00, 01, 10 and 11 given in that order. Pixels
+// of other colors are remapped to the nearest of those and recorded as a
+// Clash.
 func (image *Image) MulticolorSprite(xoffset, yoffset int, colors []byte) []byte {
-	spr := make([]byte, 64)
 	pixels := image.Pixels(xoffset, yoffset, 12, 21)
-	//fmt.Printf("[%d,%d] %v\n", xoffset, yoffset, pixels)
+	image.remapSprite(xoffset, yoffset, pixels, colors)
+	return packSprite(spriteBits(pixels, colors), 2)
+}
+
+// spriteBits returns the index of each pixel color among the given colors
+func spriteBits(pixels [][]byte, colors []byte) [][]byte {
+	bits := make([][]byte, len(pixels))
+	for y := range pixels {
+		bits[y] = make([]byte, len(pixels[y]))
+		for x, c := range pixels[y] {
+			bits[y][x] = bitsOf(colors, c)
+		}
+	}
+	return bits
+}
+
+// packSprite packs the bit values of 21 rows of sprite pixels into a
+// 64-byte sprite, with the given number of bits per pixel: 1 for hires
+// sprites and 2 for multicolor sprites
+func packSprite(bits [][]byte, depth uint) []byte {
+	spr := make([]byte, 64)
 	for y := 0; y < 21; y++ {
-		for c := 0; c < 3; c++ {
-			i := y*3 + c
-			for x := 0; x < 4; x++ {
-				n := bytes.IndexByte(colors, pixels[y][c*4+x])
-				if n >= 0 {
-					spr[i] = (spr[i] << 2) + byte(n)
-				}
-			}
+		for x, v := range bits[y] {
+			i := y*3 + x*int(depth)/8
+			spr[i] = (spr[i] << depth) + v
 		}
 	}
 	return spr
 }
 
-// MulticolorChar extracts a 4x8 pixels multicolor cell as a 10-byte array,
-// the first 8 bytes are bitmap data, followed by a screen byte and
-// a colmap byte
+// remapSprite remaps pixels of other colors than the given ones to the
+// nearest of those, recording what was changed as a Clash
+func (image *Image) remapSprite(xoffset, yoffset int, pixels [][]byte, colors []byte) {
+	image.remapPixels(xoffset, yoffset, pixels, image.sourceSamples(xoffset, yoffset, len(pixels[0]), len(pixels)), colors)
+}
+
+// remapPixels works like remapSprite, but finds the nearest colors to
+// the given source samples, one for each pixel row by row
+func (image *Image) remapPixels(xoffset, yoffset int, pixels [][]byte, samples []color.Color, colors []byte) {
+	used := colorsUsedNoBg(pixels)
+	fits := true
+	for _, c := range used {
+		fits = fits && containsColor(colors, c)
+	}
+	if fits {
+		return
+	}
+	clash := Clash{X: xoffset, Y: yoffset, Colors: used, Kept: colors}
+	choices := image.paletteColors(colors)
+	for y := range pixels {
+		for x := range pixels[y] {
+			if containsColor(colors, pixels[y][x]) {
+				continue
+			}
+			i, d := nearestColor(samples[y*len(pixels[y])+x], choices, image.distance)
+			pixels[y][x] = colors[i]
+			clash.Changed++
+			clash.Error += d
+		}
+	}
+	image.Clashes = append(image.Clashes, clash)
+}
+
+// MulticolorChar extracts a 4x8 pixels multicolor char as a 9-byte array.
+// The first 8 bytes are char data, using bit pairs 00 for the background
+// color and 01 and 10 for the first two colors set by SetMultiColors,
+// which are shared by all chars. The 9th byte is the color RAM value of
+// the char, with bit 3 set to select multicolor mode and the low bits
+// giving the color of bit pair 11: the one other color below 8 used by
+// the char, or the third color set by SetMultiColors if it uses none.
+// Callers wanting only the char data should use the first 8 bytes. An
+// error is returned if the third color set by SetMultiColors is above 7,
+// as color RAM values from 8 up select multicolor mode.
 func (image *Image) MulticolorChar(xoffset, yoffset int) ([]byte, error) {
-	char := make([]byte, 8)
+	char := make([]byte, 9)
 	pixels := image.Pixels(xoffset, yoffset, 4, 8)
-	colors := []byte{image.BgColor}
 	if image.mColors == nil {
 		return []byte{}, errors.New("MulticolorChar called without setting colors.")
 	}
-	colors = append(colors, image.mColors...)
+	if err := checkCharFallback(image.mColors[2]); err != nil {
+		return []byte{}, err
+	}
+	shared := []byte{image.BgColor, image.mColors[0], image.mColors[1]}
+	colors, err := image.charColors(xoffset, yoffset, pixels, shared, image.mColors[2], 8)
 	//fmt.Printf("colors: %+v, pixels: %+v\n", colors, pixels)
 	for y := 0; y < 8; y++ {
 		for x := 0; x < 4; x++ {
-			char[y] = (char[y] << 2) + byte(bytes.IndexByte(colors, pixels[y][x]))
+			char[y] = (char[y] << 2) + bitsOf(colors, pixels[y][x])
 		}
 	}
-	return char, nil
+	char[8] = colors[3] | 8
+	return char, err
+}
+
+// HiresChar extracts a 8x8 pixels hires char as a 9-byte array, the first
+// 8 bytes are char data, followed by a color RAM byte for the set bits
+func (image *Image) HiresChar(xoffset, yoffset int) ([]byte, error) {
+	char := make([]byte, 9)
+	pixels := image.Pixels(xoffset, yoffset, 8, 8)
+	colors, err := image.charColors(xoffset, yoffset, pixels, []byte{image.BgColor}, 0, 16)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			char[y] = (char[y] << 1) + bitsOf(colors, pixels[y][x])
+		}
+	}
+	char[8] = colors[1]
+	return char, err
+}
+
+// checkCharFallback returns an error if a multicolor char using no other
+// color can't be given color c in color RAM
+func checkCharFallback(c byte) error {
+	if c > 7 {
+		return fmt.Errorf("Invalid multicolor %d for chars using no other color", c)
+	}
+	return nil
+}
+
+// charColors returns the shared colors followed by the color RAM color of
+// a char, which is the one other color used by the char if it is below
+// limit, or fallback if the char uses no other color
+func (image *Image) charColors(xoffset, yoffset int, pixels [][]byte, shared []byte, fallback, limit byte) ([]byte, error) {
+	used := append([]byte{}, shared...)
+	candidates := append([]byte{}, shared...)
+	for _, c := range colorsUsedNoBg(pixels) {
+		if !containsColor(shared, c) {
+			used = append(used, c)
+			if c < limit {
+				candidates = append(candidates, c)
+			}
+		}
+	}
+	if len(used) == len(shared) {
+		return append(used, fallback), nil
+	}
+	if len(used) == len(shared)+1 && used[len(shared)] < limit {
+		return used, nil
+	}
+	if image.Resolve {
+		colors := image.resolveClashWith(xoffset, yoffset, pixels, used, candidates, shared, 1)
+		if len(colors) == len(shared) {
+			colors = append(colors, fallback)
+		}
+		return colors, nil
+	}
+	image.AddClash(xoffset, yoffset, used)
+	return append(append([]byte{}, shared...), fallback),
+		fmt.Errorf("Too many colors in char at x=%3d, y=%3d: %v\n", xoffset, yoffset, used)
 }
 
 // MulticolorCell extracts a 4x8 pixels multicolor cell as a 10-byte array,
@@ -138,16 +411,18 @@ func (image *Image) MulticolorCell(xoffset, yoffset int) ([]byte, error) {
 	pixels := image.Pixels(xoffset, yoffset, 4, 8)
 	//fmt.Printf("x=%d, y=%d, pixels: %+v\n", xoffset, yoffset, pixels)
 	colors := colorsUsed(pixels, image.BgColor)
-	for len(colors) < 4 {
-		colors = append(colors, 0)
+	if len(colors) > 4 && image.Resolve {
+		colors = image.resolveClash(xoffset, yoffset, pixels, colors, []byte{image.BgColor}, 3)
 	}
+	slots := image.assignSlots(colors[1:], []int{SlotScreenHigh, SlotScreenLow, SlotColorRAM})
+	bits := []byte{image.BgColor, slots[SlotScreenHigh], slots[SlotScreenLow], slots[SlotColorRAM]}
 	for y := 0; y < 8; y++ {
 		for x := 0; x < 4; x++ {
-			cell[y] = (cell[y] << 2) + byte(bytes.IndexByte(colors, pixels[y][x]))
+			cell[y] = (cell[y] << 2) + bitsOf(bits, pixels[y][x])
 		}
 	}
-	cell[8] = colors[1]*16 + colors[2]
-	cell[9] = colors[3]
+	cell[8] = slots[SlotScreenHigh]*16 + slots[SlotScreenLow]
+	cell[9] = slots[SlotColorRAM]
 	if len(colors) > 4 {
 		image.AddClash(xoffset, yoffset, colors)
 		return cell, fmt.Errorf("Too many colors in cell at x=%3d, y=%3d: %v\n", xoffset, yoffset, colors)
@@ -155,21 +430,29 @@ func (image *Image) MulticolorCell(xoffset, yoffset int) ([]byte, error) {
 	return cell, nil
 }
 
-// HiresCell extracts a 4x8 pixels multicolor cell as a 9-byte array,
+// HiresCell extracts a 8x8 pixels hires cell as a 9-byte array,
 // the first 8 bytes are bitmap data, followed by a screen byte
 func (image *Image) HiresCell(xoffset, yoffset int) ([]byte, error) {
-	cell := make([]byte, 9)
-	pixels := image.Pixels(xoffset, yoffset, 8, 8)
+	return image.hiresCell(xoffset, yoffset, 8)
+}
+
+// hiresCell extracts a 8 pixels wide hires cell of the given height as
+// bitmap bytes followed by a screen byte
+func (image *Image) hiresCell(xoffset, yoffset, height int) ([]byte, error) {
+	cell := make([]byte, height+1)
+	pixels := image.Pixels(xoffset, yoffset, 8, height)
 	colors := colorsUsedNoBg(pixels)
-	for len(colors) < 2 {
-		colors = append(colors, 0)
+	if len(colors) > 2 && image.Resolve {
+		colors = image.resolveClash(xoffset, yoffset, pixels, colors, nil, 2)
 	}
-	for y := 0; y < 8; y++ {
+	slots := image.assignSlots(colors, []int{SlotScreenLow, SlotScreenHigh})
+	bits := []byte{slots[SlotScreenLow], slots[SlotScreenHigh]}
+	for y := 0; y < height; y++ {
 		for x := 0; x < 8; x++ {
-			cell[y] = (cell[y] << 1) + byte(bytes.IndexByte(colors, pixels[y][x]))
+			cell[y] = (cell[y] << 1) + bitsOf(bits, pixels[y][x])
 		}
 	}
-	cell[8] = colors[0]*16 + colors[1]
+	cell[height] = slots[SlotScreenHigh]*16 + slots[SlotScreenLow]
 	if len(colors) > 2 {
 		image.AddClash(xoffset, yoffset, colors)
 		return cell, fmt.Errorf("Too many colors in cell at x=%3d, y=%3d: %v\n", xoffset, yoffset, colors)
@@ -182,6 +465,9 @@ func (image *Image) Hires(xoffset, yoffset int) *Hires {
 	hires := Hires{
 		Bitmap: make([]byte, 8000),
 		Screen: make([]byte, 1000)}
+	image.dither(img.Rect(xoffset, yoffset, xoffset+320, yoffset+200), 8, 8, func(x, y int) []byte {
+		return nil
+	}, 2)
 	for row := 0; row < 25; row++ {
 		for col := 0; col < 40; col++ {
 			cell, err := image.HiresCell(xoffset+col*8, yoffset+row*8)
@@ -202,6 +488,9 @@ func (image *Image) Koala(xoffset, yoffset int) *Koala {
 		Screen:  make([]byte, 1000),
 		Colmap:  make([]byte, 1000),
 		BgColor: image.BgColor}
+	image.dither(img.Rect(xoffset, yoffset, xoffset+160, yoffset+200), 4, 8, func(x, y int) []byte {
+		return []byte{image.BgColor}
+	}, 3)
 	for row := 0; row < 25; row++ {
 		for col := 0; col < 40; col++ {
 			cell, err := image.MulticolorCell(xoffset+col*4, yoffset+row*8)
@@ -216,6 +505,10 @@ func (image *Image) Koala(xoffset, yoffset int) *Koala {
 	return &koala
 }
 
+// SetMultiColors sets the colors shared by all cells of a multicolor
+// image. For chars, main and mcol1 are the shared multicolors $D022 and
+// $D023, and mcol2 is the color RAM color (0-7) given to chars using no
+// color of their own, see MulticolorChar, which rejects it if above 7.
 func (image *Image) SetMultiColors(main, mcol1, mcol2 byte) {
 	if image.mcol {
 		image.mColors = []byte{main, mcol1, mcol2}
@@ -229,6 +522,49 @@ func (image *Image) AddClash(xoffset, yoffset int, colors []byte) {
 		Clash{X: xoffset, Y: yoffset, Colors: colors})
 }
 
+// resolveClash picks the fixed colors and up to free of the used colors
+// that best match the source pixels of a cell, remaps the other pixels to
+// the nearest of those and records what was changed as a Clash
+func (image *Image) resolveClash(xoffset, yoffset int, pixels [][]byte, used []byte, fixed []byte, free int) []byte {
+	return image.resolveClashWith(xoffset, yoffset, pixels, used, used, fixed, free)
+}
+
+// resolveClashWith works like resolveClash, but picks the free colors
+// from candidates only
+func (image *Image) resolveClashWith(xoffset, yoffset int, pixels [][]byte, used, candidates []byte, fixed []byte, free int) []byte {
+	samples := image.sourceSamples(xoffset, yoffset, len(pixels[0]), len(pixels))
+	kept := image.bestColors(samples, fixed, free, candidates)
+	clash := Clash{X: xoffset, Y: yoffset, Colors: used, Kept: kept}
+	choices := image.paletteColors(kept)
+	for y := range pixels {
+		for x := range pixels[y] {
+			if containsColor(kept, pixels[y][x]) {
+				continue
+			}
+			i, d := nearestColor(samples[y*len(pixels[y])+x], choices, image.distance)
+			pixels[y][x] = kept[i]
+			image.setPixel(xoffset+x, yoffset+y, kept[i])
+			clash.Changed++
+			clash.Error += d
+		}
+	}
+	image.Clashes = append(image.Clashes, clash)
+	return kept
+}
+
+// WriteClashReport writes a line for each clash, describing how it was
+// resolved if it was
+func (image *Image) WriteClashReport(w io.Writer) {
+	for _, clash := range image.Clashes {
+		if clash.Kept == nil {
+			fmt.Fprintf(w, "Unresolved clash in cell at x=%3d, y=%3d: %v\n", clash.X, clash.Y, clash.Colors)
+		} else {
+			fmt.Fprintf(w, "Resolved clash in cell at x=%3d, y=%3d: %v -> %v, %d pixels changed, error %.1f\n",
+				clash.X, clash.Y, clash.Colors, clash.Kept, clash.Changed, clash.Error)
+		}
+	}
+}
+
 func (image *Image) WriteClashesToPNG(filename string) {
 	t := img.NewRGBA(img.Rectangle{img.Point{0, 0}, img.Point{1042, 652}})
 	for y := 0; y < 652; y++ {
@@ -245,8 +581,12 @@ func (image *Image) WriteClashesToPNG(filename string) {
 		}
 	}
 	ccol := color.RGBA{255, 0, 0, 0xff}
+	cellWidth := 8
+	if image.mcol {
+		cellWidth = 4
+	}
 	for _, clash := range image.Clashes {
-		x := (clash.X / 4) * 26
+		x := (clash.X / cellWidth) * 26
 		y := (clash.Y / 8) * 26
 		for i := 0; i < 28; i += 2 {
 			t.Set(x+i, y, ccol)
@@ -262,47 +602,99 @@ func (image *Image) WriteClashesToPNG(filename string) {
 
 	f, err := os.Create(filename)
 	if err != nil {
-		fmt.Errorf("Failed to create file %v: %v", filename, err)
+		fmt.Fprintf(os.Stderr, "Failed to create file %v: %v\n", filename, err)
 		return
 	}
+	defer f.Close()
 	png.Encode(f, t)
 }
 
-func pngImage(filename string) *img.Paletted {
-	file, err := os.Open(filename)
+// WritePNG writes an image to a PNG file
+func WritePNG(filename string, image img.Image) error {
+	f, err := os.Create(filename)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer file.Close()
+	defer f.Close()
+	return png.Encode(f, image)
+}
 
-	decoded, err := png.Decode(file)
-	if err != nil {
-		panic(err)
+// pixelIndex returns the offset of the given pixel in the pixels and
+// deltas slices, or -1 if it is outside the image
+func (image *Image) pixelIndex(x, y int) int {
+	bounds := image.img.Bounds()
+	if !(img.Point{x, y}).In(bounds) {
+		return -1
 	}
-	return decoded.(*img.Paletted)
+	return (y-bounds.Min.Y)*bounds.Dx() + x - bounds.Min.X
 }
 
-func remapIndices(from color.Palette, to []color.Color) []byte {
-	//fmt.Printf("remapIndices:\n  from: %+v\n  to: %+v\n", from, to)
-	colors := make([]byte, 16)
-	for index, color := range to {
-		//i := from.Index(color) // BUGGY! Finds colors not used
-		i := -1
-		for fi, fc := range from {
-			if fc == color {
-				i = fi
-			}
+// detectPalette returns the palette that best matches the colors of source
+func detectPalette(source img.Image) *Palette {
+	var colors []color.Color
+	if paletted, ok := source.(*img.Paletted); ok {
+		colors = paletted.Palette
+	} else {
+		colors = groupedColors(distinctColors(source))
+	}
+	palette, _, _ := PaletteBestMatch(colors)
+	return palette
+}
+
+// maxDetectColors is the number of distinct colors above which similar
+// colors are grouped before detecting the palette
+const maxDetectColors = 256
+
+// groupedColors returns colors as is if there are at most maxDetectColors
+// of them, or else the mean of each group of colors sharing the upper 4
+// bits of every channel, so that photos don't make detection slow
+func groupedColors(colors []color.Color) []color.Color {
+	if len(colors) <= maxDetectColors {
+		return colors
+	}
+	sums := map[uint32][4]uint64{}
+	keys := []uint32{}
+	for _, c := range colors {
+		r, g, b, _ := c.RGBA()
+		key := r>>12<<8 | g>>12<<4 | b>>12
+		sum, found := sums[key]
+		if !found {
+			keys = append(keys, key)
 		}
-		if i >= 0 {
-			//fmt.Printf("    Found color %+v at from[%d], vic-index is %d\n", color, i, index)
-			colors[i] = byte(index)
-		} else {
-			//fmt.Printf("    Color with vic-index %d was not found in image.", index)
+		sums[key] = [4]uint64{sum[0] + uint64(r), sum[1] + uint64(g), sum[2] + uint64(b), sum[3] + 1}
+	}
+	grouped := make([]color.Color, len(keys))
+	for i, key := range keys {
+		sum := sums[key]
+		grouped[i] = color.RGBA64{uint16(sum[0] / sum[3]), uint16(sum[1] / sum[3]), uint16(sum[2] / sum[3]), 0xffff}
+	}
+	return grouped
+}
+
+// distinctColors returns each color used in source once
+func distinctColors(source img.Image) []color.Color {
+	seen := map[color.RGBA64]bool{}
+	colors := []color.Color{}
+	bounds := source.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.RGBA64Model.Convert(source.At(x, y)).(color.RGBA64)
+			if !seen[c] {
+				seen[c] = true
+				colors = append(colors, c)
+			}
 		}
 	}
 	return colors
 }
 
+// remapIndices returns the index of the perceptually nearest color of
+// the palette for each color in from, as given by Palette.Mapping
+func remapIndices(from color.Palette, to *Palette) []byte {
+	mapping, _ := to.Mapping(from)
+	return mapping
+}
+
 func histogram(pixels [][]byte) map[byte]int {
 	counts := make(map[byte]int)
 	for _, row := range pixels {
@@ -313,22 +705,34 @@ func histogram(pixels [][]byte) map[byte]int {
 	return counts
 }
 
+// colorsUsed returns the background color followed by the other colors
+// used in pixels, in ascending order
 func colorsUsed(pixels [][]byte, bgColor byte) []byte {
-	counts := histogram(pixels)
 	colors := []byte{bgColor}
-	for key, _ := range counts {
-		if key != bgColor {
-			colors = append(colors, key)
+	for _, c := range colorsUsedNoBg(pixels) {
+		if c != bgColor {
+			colors = append(colors, c)
 		}
 	}
 	return colors
 }
 
+// colorsUsedNoBg returns the colors used in pixels, in ascending order
 func colorsUsedNoBg(pixels [][]byte) []byte {
 	counts := histogram(pixels)
 	colors := []byte{}
-	for key, _ := range counts {
-		colors = append(colors, key)
+	for c := 0; c < 256; c++ {
+		if counts[byte(c)] > 0 {
+			colors = append(colors, byte(c))
+		}
 	}
 	return colors
 }
+
+// bitsOf returns the index of c in bits, or 0 if c is not there
+func bitsOf(bits []byte, c byte) byte {
+	if i := bytes.IndexByte(bits, c); i >= 0 {
+		return byte(i)
+	}
+	return 0
+}
@@ -0,0 +1,311 @@
+package gfx
+
+import (
+	"bytes"
+	img "image"
+	"image/color"
+	"math"
+)
+
+// Interlace represents an interlaced multicolor image made of two frames
+// that are shown alternately, the second one shifted one hires pixel to
+// the right, so that the eye blends their colors. In Drazlace images both
+// frames share screen and color map, while IFLI images have separate FLI
+// screens for each frame and share the color map only.
+type Interlace struct {
+	Frames [2]*FLI
+	IFLI   bool
+}
+
+// Drazlace returns the image in Drazlace layout, to be loaded at $5800:
+// the color map and the screen, each aligned to 1024 bytes, the bitmap of
+// the first frame, the background color and shift flag padded to 192
+// bytes, and the bitmap of the second frame.
+func (il *Interlace) Drazlace() []byte {
+	flags := make([]byte, 192)
+	flags[0], flags[2] = il.Frames[0].BgColor, 1
+	return bytes.Join([][]byte{
+		il.Frames[0].Colmap, make([]byte, 24),
+		il.Frames[0].Screens[0], make([]byte, 24),
+		il.Frames[0].Bitmap, flags,
+		il.Frames[1].Bitmap,
+	}, []byte{})
+}
+
+// FrameData returns the image as two FLI frames, to be loaded at $4000:
+// for each frame, the 8 screens aligned to 1024 bytes followed by the
+// bitmap padded to 8192 bytes, with the background color in the first
+// padding byte of the first frame, and finally the color map. This is
+// not the layout of Gunpaint or any other IFLI editor.
+func (il *Interlace) FrameData() []byte {
+	segments := [][]byte{}
+	for f, frame := range il.Frames {
+		for _, screen := range frame.Screens {
+			segments = append(segments, screen, make([]byte, 24))
+		}
+		padding := make([]byte, 192)
+		if f == 0 {
+			padding[0] = frame.BgColor
+		}
+		segments = append(segments, frame.Bitmap, padding)
+	}
+	segments = append(segments, il.Frames[0].Colmap)
+	return bytes.Join(segments, []byte{})
+}
+
+// Render returns a 320x200 preview of the image as the eye perceives it,
+// blending both frames using the mixed colors of the given palette
+func (il *Interlace) Render(palette *Palette) *img.RGBA {
+	mixes := palette.MixTable()
+	rendered := img.NewRGBA(img.Rect(0, 0, 320, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 320; x++ {
+			c0, c1 := il.Frames[0].ColorAt(x/2, y), il.Frames[1].BgColor
+			if x > 0 {
+				c1 = il.Frames[1].ColorAt((x-1)/2, y)
+			}
+			rendered.Set(x, y, mixes[c0][c1])
+		}
+	}
+	return rendered
+}
+
+// Interlace decomposes a full-screen 160x200 area of the image into two
+// multicolor frames whose blended colors best match the source colors,
+// in Drazlace format or, if ifli is true, in IFLI format with the leftmost
+// bugColumns char columns left blank. The colors of each cell are picked
+// to fit it, so there are no clashes and Resolve has no effect. Dithering
+// is not supported.
+func (image *Image) Interlace(xoffset, yoffset int, ifli bool, bugColumns int) *Interlace {
+	if image.Dither != NoDither {
+		panic("Can't dither interlaced image.")
+	}
+	il := &Interlace{IFLI: ifli}
+	for f := range il.Frames {
+		il.Frames[f] = &FLI{
+			Bitmap:  make([]byte, 8000),
+			Screens: make([][]byte, 8),
+			Colmap:  make([]byte, 1000),
+			BgColor: image.BgColor}
+		for i := range il.Frames[f].Screens {
+			il.Frames[f].Screens[i] = make([]byte, 1000)
+		}
+	}
+	mixes := image.mapped.MixTable()
+	first := 0
+	if ifli {
+		first = bugColumns
+	}
+	for row := 0; row < 25; row++ {
+		// left holds the frame 1 color of the pixel left of each pixel row
+		// of the cell, which blends with its first frame 0 pixel
+		left := make([]byte, 8)
+		for y := range left {
+			left[y] = image.BgColor
+		}
+		for col := first; col < 40; col++ {
+			hires := image.hiresSamples(xoffset+col*4, yoffset+row*8, 4, 8)
+			distances := make([][][]float64, len(hires))
+			for s, sample := range hires {
+				distances[s] = make([][]float64, len(mixes))
+				for i := range mixes {
+					distances[s][i] = make([]float64, len(mixes))
+					for j := range mixes {
+						distances[s][i][j] = image.distance(sample, mixes[i][j])
+					}
+				}
+			}
+			if ifli {
+				samples := image.sourceSamples(xoffset+col*4, yoffset+row*8, 4, 8)
+				image.ifliCell(il, row*40+col, xoffset+col*4, yoffset+row*8, samples, distances, left)
+			} else {
+				image.drazlaceCell(il, row*40+col, xoffset+col*4, yoffset+row*8, distances, left)
+			}
+		}
+	}
+	return il
+}
+
+// drazlaceCell picks the four colors of a cell shared by both frames and
+// sets the pixels of each frame to the colors that blend best with the
+// second frame shifted one hires pixel to the right, given the colors of
+// the second frame left of each pixel row, which are updated
+func (image *Image) drazlaceCell(il *Interlace, offset, xoffset, yoffset int, distances [][][]float64, left []byte) {
+	fixed := []byte{image.BgColor}
+	colors := image.bestPairColors(distances, fixed, 3, nil)
+	slots := image.assignSlots(colors[1:], []int{SlotScreenHigh, SlotScreenLow, SlotColorRAM})
+	bits := []byte{image.BgColor, slots[SlotScreenHigh], slots[SlotScreenLow], slots[SlotColorRAM]}
+	for y := 0; y < 8; y++ {
+		p := shiftedPairs(distances[y*8:y*8+8], colors, colors, left[y])
+		left[y] = p[3][1]
+		for f, frame := range il.Frames {
+			for x := 0; x < 4; x++ {
+				frame.Bitmap[(offset/40)*320+(offset%40)*8+y] <<= 2
+				frame.Bitmap[(offset/40)*320+(offset%40)*8+y] += bitsOf(bits, p[x][f])
+			}
+			frame.Screens[y][offset] = slots[SlotScreenHigh]*16 + slots[SlotScreenLow]
+		}
+	}
+	il.Frames[0].Colmap[offset] = slots[SlotColorRAM]
+	il.Frames[1].Colmap[offset] = slots[SlotColorRAM]
+}
+
+// ifliCell picks the color map color of a cell, then for each pixel row
+// the two screen colors of each frame that together blend best, and sets
+// the pixels of each frame accordingly, like drazlaceCell
+func (image *Image) ifliCell(il *Interlace, offset, xoffset, yoffset int, samples []color.Color, distances [][][]float64, left []byte) {
+	ram := byte(image.slotFiller(SlotColorRAM))
+	if chosen := image.bestColors(samples, []byte{image.BgColor}, 1, image.candidates(samples, 2)); len(chosen) > 1 {
+		ram = chosen[1]
+	}
+	fixed := []byte{image.BgColor, ram}
+	for y := 0; y < 8; y++ {
+		row := distances[y*8 : y*8+8]
+		colors := [2][]byte{}
+		colors[0] = image.bestPairColors(row, fixed, 2, nil)
+		colors[1] = colors[0]
+		for i := 0; i < 2; i++ {
+			colors[1] = image.bestPairColors(row, fixed, 2, colors[0])
+			colors[0] = image.bestPairColors(row, fixed, 2, colors[1])
+		}
+		p := shiftedPairs(row, colors[0], colors[1], left[y])
+		left[y] = p[3][1]
+		for f, frame := range il.Frames {
+			slots := image.assignSlots(colors[f][2:], []int{SlotScreenHigh, SlotScreenLow})
+			bits := []byte{image.BgColor, slots[SlotScreenHigh], slots[SlotScreenLow], ram}
+			for x := 0; x < 4; x++ {
+				frame.Bitmap[(offset/40)*320+(offset%40)*8+y] <<= 2
+				frame.Bitmap[(offset/40)*320+(offset%40)*8+y] += bitsOf(bits, p[x][f])
+			}
+			frame.Screens[y][offset] = slots[SlotScreenHigh]*16 + slots[SlotScreenLow]
+			frame.Colmap[offset] = ram
+		}
+	}
+}
+
+// bestPairColors returns the fixed colors followed by the free other
+// colors that minimize the total distance from each sample to its best
+// blend of a color from the result and a color from other. If other is
+// nil, the result itself is used for both frames.
+func (image *Image) bestPairColors(distances [][][]float64, fixed []byte, free int, other []byte) []byte {
+	options := []byte{}
+	for _, c := range pairCandidates(distances, 4) {
+		if !containsColor(fixed, c) {
+			options = append(options, c)
+		}
+	}
+	for c := 0; len(options) < free; c++ {
+		if !containsColor(fixed, byte(c)) && !containsColor(options, byte(c)) {
+			options = append(options, byte(c))
+		}
+	}
+	var best []byte
+	bestCost := math.Inf(1)
+	combinations(len(options), free, func(chosen []byte) {
+		colors := append([]byte{}, fixed...)
+		for _, i := range chosen {
+			colors = append(colors, options[i])
+		}
+		others := other
+		if others == nil {
+			others = colors
+		}
+		total := 0.0
+		for _, d := range distances {
+			nearest := math.Inf(1)
+			for _, p := range colors {
+				for _, q := range others {
+					nearest = math.Min(nearest, d[p][q])
+				}
+			}
+			total += nearest
+			if total >= bestCost {
+				return
+			}
+		}
+		best, bestCost = colors, total
+	})
+	return best
+}
+
+// shiftedPairs returns the colors from first and second of each pair of
+// multicolor pixels of the two frames, for a row of hires samples where
+// the second frame is shifted one hires pixel to the right, so that hires
+// pixel 2k blends frame pixels k and k-1 and pixel 2k+1 frame pixels k and
+// k. The frame pixels form a chain, which is solved exactly given the
+// color left of the row in the second frame.
+func shiftedPairs(distances [][][]float64, first, second []byte, left byte) [][2]byte {
+	n := len(distances) / 2
+	// nodes alternate between the pixels of the first and second frame
+	sets := [2][]byte{first, second}
+	costs := make([][]float64, 2*n)
+	from := make([][]int, 2*n)
+	for i := range costs {
+		set := sets[i%2]
+		costs[i] = make([]float64, len(set))
+		from[i] = make([]int, len(set))
+		for j, c := range set {
+			if i == 0 {
+				costs[i][j] = distances[0][c][left]
+				continue
+			}
+			costs[i][j] = math.Inf(1)
+			for k, pc := range sets[(i-1)%2] {
+				var d float64
+				if i%2 == 1 {
+					d = distances[i][pc][c]
+				} else {
+					d = distances[i][c][pc]
+				}
+				if cost := costs[i-1][k] + d; cost < costs[i][j] {
+					costs[i][j], from[i][j] = cost, k
+				}
+			}
+		}
+	}
+	j := 0
+	for k, cost := range costs[2*n-1] {
+		if cost < costs[2*n-1][j] {
+			j = k
+		}
+	}
+	pairs := make([][2]byte, n)
+	for i := 2*n - 1; i >= 0; i-- {
+		pairs[i/2][i%2] = sets[i%2][j]
+		j = from[i][j]
+	}
+	return pairs
+}
+
+// pairCandidates returns the colors that are part of any of the n best
+// blends for any of the samples, in ascending order
+func pairCandidates(distances [][][]float64, n int) []byte {
+	found := map[byte]bool{}
+	for _, d := range distances {
+		best := make([][2]int, 0, n+1)
+		for p := range d {
+			for q := p; q < len(d[p]); q++ {
+				i := len(best)
+				for i > 0 && d[p][q] < d[best[i-1][0]][best[i-1][1]] {
+					i--
+				}
+				if i < n {
+					best = append(best[:i], append([][2]int{{p, q}}, best[i:]...)...)
+					if len(best) > n {
+						best = best[:n]
+					}
+				}
+			}
+		}
+		for _, pair := range best {
+			found[byte(pair[0])], found[byte(pair[1])] = true, true
+		}
+	}
+	colors := []byte{}
+	for c := 0; c < len(distances[0]); c++ {
+		if found[byte(c)] {
+			colors = append(colors, byte(c))
+		}
+	}
+	return colors
+}
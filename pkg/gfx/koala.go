@@ -2,6 +2,16 @@ package gfx
 
 import (
 	"bytes"
+	"fmt"
+	img "image"
+	"io"
+)
+
+// Sizes of Koala data without load address, as produced by Koala.Bytes
+const (
+	koalaSize         = 10001
+	koalaAlignedBack  = 10217
+	koalaAlignedFront = 10048
 )
 
 // Koala represents a full-screen image in KoalaPainter format
@@ -50,8 +60,101 @@ func (koala *Koala) Bytes(align bool, front bool) []byte {
 	}
 }
 
+// ColorAt returns the color index of the multicolor pixel at x (0-159), y (0-199)
+func (koala *Koala) ColorAt(x, y int) byte {
+	offset := (y/8)*40 + x/4
+	value := koala.Bitmap[(y/8)*320+(x/4)*8+y%8]
+	switch (value >> uint(6-(x%4)*2)) & 3 {
+	case 1:
+		return koala.Screen[offset] >> 4
+	case 2:
+		return koala.Screen[offset] & 0x0F
+	case 3:
+		return koala.Colmap[offset] & 0x0F
+	}
+	return koala.BgColor & 0x0F
+}
+
+// Render returns the Koala image as a 320x200 paletted image using the
+// given palette, with each multicolor pixel two pixels wide
+func (koala *Koala) Render(palette *Palette) *img.Paletted {
+	rendered := img.NewPaletted(img.Rect(0, 0, 320, 200), palette.Colors)
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 160; x++ {
+			c := koala.ColorAt(x, y)
+			rendered.SetColorIndex(x*2, y, c)
+			rendered.SetColorIndex(x*2+1, y, c)
+		}
+	}
+	return rendered
+}
+
+// ParseKoala reads Koala data in any of the layouts produced by Bytes,
+// with or without load address. Unaligned data is assumed to have the
+// bitmap in front unless only the other layout has a valid color map.
+func ParseKoala(r io.Reader) (*Koala, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	switch len(data) {
+	case koalaSize + 2, koalaAlignedBack + 2, koalaAlignedFront + 2:
+		data = data[2:]
+	}
+	switch len(data) {
+	case koalaSize:
+		front := !isNibbles(data[9000:10001]) && isNibbles(data[1000:2001])
+		return ParseKoalaLayout(bytes.NewReader(data), false, front)
+	case koalaAlignedBack:
+		return ParseKoalaLayout(bytes.NewReader(data), true, false)
+	case koalaAlignedFront:
+		return ParseKoalaLayout(bytes.NewReader(data), true, true)
+	}
+	return nil, fmt.Errorf("Unexpected size of Koala data: %d bytes", len(data))
+}
+
+// ParseKoalaLayout reads Koala data without load address in the layout
+// given by align and front, as described for Bytes
+func ParseKoalaLayout(r io.Reader, align bool, front bool) (*Koala, error) {
+	var bitmap, screen, colmap, bgColor int
+	var size int
+	switch {
+	case align && front:
+		screen, colmap, bgColor, bitmap, size = 0, 1024, 2047, 2048, koalaAlignedFront
+	case align:
+		bitmap, screen, colmap, bgColor, size = 0, 8192, 9216, 10216, koalaAlignedBack
+	case front:
+		screen, colmap, bgColor, bitmap, size = 0, 1000, 2000, 2001, koalaSize
+	default:
+		bitmap, screen, colmap, bgColor, size = 0, 8000, 9000, 10000, koalaSize
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("Failed to read Koala data: %v", err)
+	}
+	koala := Koala{
+		Bitmap:  make([]byte, 8000),
+		Screen:  make([]byte, 1000),
+		Colmap:  make([]byte, 1000),
+		BgColor: data[bgColor] & 0x0F}
+	copy(koala.Bitmap, data[bitmap:])
+	copy(koala.Screen, data[screen:])
+	copy(koala.Colmap, data[colmap:])
+	return &koala, nil
+}
+
 // KoalaImage reads an image from a PNG file and returns a Koala pointer
 func KoalaImage(filename string, bgColor byte) *Koala {
 	image := MulticolorImage(filename, bgColor)
 	return image.Koala(0, 0)
 }
+
+// isNibbles returns true if no byte in data has any of the upper four bits set
+func isNibbles(data []byte) bool {
+	for _, b := range data {
+		if b > 0x0F {
+			return false
+		}
+	}
+	return true
+}
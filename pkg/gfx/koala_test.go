@@ -0,0 +1,66 @@
+package gfx
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// randomBytes returns n pseudo-random bytes below limit
+func randomBytes(rng *rand.Rand, n int, limit int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(rng.Intn(limit))
+	}
+	return data
+}
+
+// withLoadAddress returns data prefixed by a load address
+func withLoadAddress(address int, data []byte) []byte {
+	return append([]byte{byte(address), byte(address >> 8)}, data...)
+}
+
+func TestKoalaRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	koala := &Koala{
+		Bitmap:  randomBytes(rng, 8000, 256),
+		Screen:  randomBytes(rng, 1000, 256),
+		Colmap:  randomBytes(rng, 1000, 16),
+		BgColor: 6}
+	layouts := []struct {
+		align, front bool
+		size         int
+	}{
+		{false, false, 10001},
+		{false, true, 10001},
+		{true, false, 10217},
+		{true, true, 10048},
+	}
+	for _, layout := range layouts {
+		data := koala.Bytes(layout.align, layout.front)
+		if len(data) != layout.size {
+			t.Errorf("align=%v, front=%v: got %d bytes, want %d", layout.align, layout.front, len(data), layout.size)
+			continue
+		}
+		for _, file := range [][]byte{data, withLoadAddress(0x6000, data)} {
+			parsed, err := ParseKoala(bytes.NewReader(file))
+			if err != nil {
+				t.Errorf("align=%v, front=%v, %d bytes: %v", layout.align, layout.front, len(file), err)
+				continue
+			}
+			if !reflect.DeepEqual(parsed, koala) {
+				t.Errorf("align=%v, front=%v, %d bytes: parsed image differs", layout.align, layout.front, len(file))
+			}
+			if !bytes.Equal(parsed.Bytes(layout.align, layout.front), data) {
+				t.Errorf("align=%v, front=%v, %d bytes: bytes differ after round trip", layout.align, layout.front, len(file))
+			}
+		}
+	}
+}
+
+func TestParseKoalaSize(t *testing.T) {
+	if _, err := ParseKoala(bytes.NewReader(make([]byte, 10000))); err == nil {
+		t.Error("expected error for 10000 bytes")
+	}
+}
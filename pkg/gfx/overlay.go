@@ -0,0 +1,225 @@
+package gfx
+
+import (
+	"bytes"
+	img "image"
+	"image/color"
+	"math"
+)
+
+// SpriteLayers represents sprite frames each split into a multicolor
+// underlay and a hires overlay shown in front of it. Both sheets have
+// the same frames, a frame only being skipped if both layers are empty.
+type SpriteLayers struct {
+	Underlay *SpriteSheet
+	Overlay  *SpriteSheet
+	Shared   []byte
+	BgColor  byte
+	Cols     int
+	Rows     int
+	Lost     int
+	Error    float64
+}
+
+// pixelPair counts the occurrences of two adjacent hires pixels covered
+// by the same multicolor pixel
+type pixelPair struct {
+	left, right byte
+	count       int
+}
+
+// Render returns the composite of the two layers of each frame laid out in
+// the original grid as a paletted image using the given palette
+func (layers *SpriteLayers) Render(palette *Palette) *img.Paletted {
+	rendered := img.NewPaletted(img.Rect(0, 0, layers.Cols*24, layers.Rows*21), palette.Colors)
+	for i := range layers.Underlay.Frames {
+		under, over := layers.Underlay.Frames[i], layers.Overlay.Frames[i]
+		colors := []byte{layers.BgColor, layers.Shared[0], layers.Underlay.Colors[i], layers.Shared[1]}
+		for y := 0; y < 21; y++ {
+			for x := 0; x < 24; x++ {
+				c := layers.BgColor
+				if under >= 0 {
+					spr := layers.Underlay.Sprites[under]
+					c = colors[(spr[y*3+x/8]>>uint(6-(x%8)/2*2))&3]
+					if (layers.Overlay.Sprites[over][y*3+x/8]>>uint(7-x%8))&1 == 1 {
+						c = layers.Overlay.Colors[i]
+					}
+				}
+				rendered.SetColorIndex((i%layers.Cols)*24+x, (i/layers.Cols)*21+y, c)
+			}
+		}
+	}
+	return rendered
+}
+
+// LayerSprites splits each of the cols x rows sprites of a hires image in
+// a grid at the given offset into a multicolor underlay and a hires
+// overlay, picking the colors of each frame that give the least error
+// and, unless given, the shared multicolors giving the least error for
+// the whole set. Underlay pixels of colors it can't show are remapped and
+// recorded as a Clash, as by MulticolorSprite. Empty frames are left out
+// if skipEmpty is set, and repeated sprites are only stored once in each
+// layer if skipDuplicates is set.
+func (image *Image) LayerSprites(xoffset, yoffset, cols, rows int, shared []byte, skipEmpty, skipDuplicates bool) *SpriteLayers {
+	frames := make([][]pixelPair, cols*rows)
+	for i := range frames {
+		frames[i] = image.pixelPairs(xoffset+(i%cols)*24, yoffset+(i/cols)*21)
+	}
+	table := image.distanceTable()
+	if shared == nil {
+		best := -1.0
+		combinations(len(image.palette), 2, func(colors []byte) {
+			if containsColor(colors, image.BgColor) {
+				return
+			}
+			sum := 0.0
+			for _, pairs := range frames {
+				_, _, d := image.bestLayerColors(pairs, table, colors)
+				sum += d
+			}
+			if best < 0 || sum < best {
+				best = sum
+				shared = append([]byte{}, colors...)
+			}
+		})
+	}
+
+	layers := SpriteLayers{
+		Underlay: &SpriteSheet{Sprites: [][]byte{}, Frames: []int{}, Colors: []byte{}},
+		Overlay:  &SpriteSheet{Sprites: [][]byte{}, Frames: []int{}, Colors: []byte{}},
+		Shared:   shared,
+		BgColor:  image.BgColor,
+		Cols:     cols,
+		Rows:     rows}
+	underIndices, overIndices := map[string]int{}, map[string]int{}
+	empty := make([]byte, 64)
+	for i, pairs := range frames {
+		x, y := xoffset+(i%cols)*24, yoffset+(i/cols)*21
+		over, under, _ := image.bestLayerColors(pairs, table, shared)
+		colors := []byte{image.BgColor, shared[0], under, shared[1]}
+		pixels := image.Pixels(x, y, 24, 21)
+		underPixels, samples := image.underlayPixels(x, y, pixels, table, over, colors)
+		image.remapPixels(x, y, underPixels, samples, colors)
+		underBits, overBits := spriteBits(underPixels, colors), make([][]byte, 21)
+		for row := range pixels {
+			overBits[row] = make([]byte, 24)
+			for col, p := range pixels[row] {
+				shown := underPixels[row][col/2]
+				if table[p][over] < table[p][shown] {
+					overBits[row][col], shown = 1, over
+				}
+				if p != shown {
+					layers.Lost++
+				}
+				layers.Error += table[p][shown]
+			}
+		}
+		underSpr, overSpr := packSprite(underBits, 2), packSprite(overBits, 1)
+		layers.Underlay.Colors = append(layers.Underlay.Colors, under)
+		layers.Overlay.Colors = append(layers.Overlay.Colors, over)
+		if skipEmpty && bytes.Equal(underSpr, empty) && bytes.Equal(overSpr, empty) {
+			layers.Underlay.Frames = append(layers.Underlay.Frames, -1)
+			layers.Overlay.Frames = append(layers.Overlay.Frames, -1)
+			continue
+		}
+		layers.Underlay.addSprite(underSpr, underIndices, skipDuplicates)
+		layers.Overlay.addSprite(overSpr, overIndices, skipDuplicates)
+	}
+	return &layers
+}
+
+// underlayPixels returns the multicolor pixels of a frame that the
+// underlay should show, along with their source colors. Each is the color
+// of a hires pixel of the pair that the overlay will not cover, the left
+// one unless the right one has the best underlay color for the pair, so it
+// may be a color the underlay can't show. If the overlay covers both
+// pixels it is the best underlay color.
+func (image *Image) underlayPixels(xoffset, yoffset int, pixels [][]byte, table [][]float64, over byte, colors []byte) ([][]byte, []color.Color) {
+	sources := image.sourceSamples(xoffset, yoffset, 24, 21)
+	underPixels := make([][]byte, 21)
+	samples := make([]color.Color, 0, 12*21)
+	for y := range pixels {
+		underPixels[y] = make([]byte, 12)
+		for x := 0; x < 24; x += 2 {
+			bits, _ := layerPair(pixels[y][x], pixels[y][x+1], table, over, colors)
+			best := colors[bits]
+			c, sample, found := best, image.palette[best], false
+			for j, p := range pixels[y][x : x+2] {
+				if table[p][over] >= table[p][best] && (!found || p == best) {
+					c, sample, found = p, sources[y*24+x+j], true
+				}
+			}
+			underPixels[y][x/2] = c
+			samples = append(samples, sample)
+		}
+	}
+	return underPixels, samples
+}
+
+// addSprite adds a frame showing the given sprite, only storing the sprite
+// if it is not there already or skipDuplicates is not set
+func (sheet *SpriteSheet) addSprite(spr []byte, indices map[string]int, skipDuplicates bool) {
+	index, found := indices[string(spr)]
+	if !found || !skipDuplicates {
+		index = len(sheet.Sprites)
+		indices[string(spr)] = index
+		sheet.Sprites = append(sheet.Sprites, spr)
+	}
+	sheet.Frames = append(sheet.Frames, index)
+}
+
+// bestLayerColors returns the overlay and underlay colors giving the least
+// error for a frame with the given shared multicolors, and the error
+func (image *Image) bestLayerColors(pairs []pixelPair, table [][]float64, shared []byte) (byte, byte, float64) {
+	var bestOver, bestUnder byte
+	best := -1.0
+	colors := []byte{image.BgColor, shared[0], 0, shared[1]}
+	for over := range image.palette {
+		for under := range image.palette {
+			colors[2] = byte(under)
+			sum := 0.0
+			for _, pair := range pairs {
+				_, d := layerPair(pair.left, pair.right, table, byte(over), colors)
+				sum += d * float64(pair.count)
+			}
+			if best < 0 || sum < best {
+				bestOver, bestUnder, best = byte(over), byte(under), sum
+			}
+		}
+	}
+	return bestOver, bestUnder, best
+}
+
+// layerPair returns the bit pair of the underlay color that together with
+// the overlay color best shows two adjacent hires pixels, and the error
+func layerPair(left, right byte, table [][]float64, over byte, colors []byte) (byte, float64) {
+	var bits byte
+	best := -1.0
+	for i, c := range colors {
+		d := math.Min(table[left][over], table[left][c]) + math.Min(table[right][over], table[right][c])
+		if best < 0 || d < best {
+			bits, best = byte(i), d
+		}
+	}
+	return bits, best
+}
+
+// pixelPairs counts the pairs of adjacent hires pixels of a sprite
+func (image *Image) pixelPairs(xoffset, yoffset int) []pixelPair {
+	pixels := image.Pixels(xoffset, yoffset, 24, 21)
+	indices := map[[2]byte]int{}
+	pairs := []pixelPair{}
+	for y := range pixels {
+		for x := 0; x < 24; x += 2 {
+			key := [2]byte{pixels[y][x], pixels[y][x+1]}
+			i, found := indices[key]
+			if !found {
+				i = len(pairs)
+				indices[key] = i
+				pairs = append(pairs, pixelPair{left: key[0], right: key[1]})
+			}
+			pairs[i].count++
+		}
+	}
+	return pairs
+}
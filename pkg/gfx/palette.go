@@ -10,8 +10,11 @@ import (
 	"image/color"
 	"io/ioutil"
 	"log"
+	"math"
+	"os"
 	"os/user"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -42,26 +45,87 @@ const (
 
 var PaletteMap = map[string]*Palette{}
 
+// PaletteConfigVariable is the environment variable naming a palette
+// config file to read instead of ~/.config/vic-palettes.json
+const PaletteConfigVariable = "BREADBOX_PALETTES"
+
 func init() {
+	configFile := os.Getenv(PaletteConfigVariable)
+	if len(configFile) > 0 {
+		if err := LoadPaletteConfig(configFile); err != nil {
+			log.Printf("Could not read palette config file: %v", err)
+		}
+	} else if usr, err := user.Current(); err == nil {
+		err := LoadPaletteConfig(filepath.Join(usr.HomeDir, ".config/vic-palettes.json"))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Could not read palette config file: %v", err)
+		}
+	}
+	for name, values := range builtinPalettes {
+		MakePalette(name, values)
+	}
+}
+
+// LoadPaletteConfig reads a JSON object mapping palette names to lists
+// of 16 hex colors separated by colons or commas, adding the palettes to
+// PaletteMap or replacing those with the same names. Nothing is added
+// unless every palette in the file is valid
+func LoadPaletteConfig(filename string) error {
 	var paletteConfig map[string]string
-	usr, _ := user.Current()
-	configFile := filepath.Join(usr.HomeDir, ".config/vic-palettes.json")
-	paletteJSON, err := ioutil.ReadFile(configFile)
+	paletteJSON, err := ioutil.ReadFile(filename)
 	if err != nil {
-		log.Printf("Could not read palette config file", err)
-		return
+		return err
+	}
+	if err := json.Unmarshal(paletteJSON, &paletteConfig); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
 	}
-	json.Unmarshal(paletteJSON, &paletteConfig)
-	for name, valueList := range paletteConfig {
-		MakePalette(name, strings.Replace(valueList, ",", ":", -1))
+	names := make([]string, 0, len(paletteConfig))
+	for name := range paletteConfig {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	palettes := make([]*Palette, len(names))
+	for i, name := range names {
+		colors, err := parseColorList(splitColorList(paletteConfig[name]))
+		if err != nil {
+			return fmt.Errorf("%s: palette %q: %v", filename, name, err)
+		}
+		palettes[i] = &Palette{Name: name, Colors: colors}
 	}
+	for _, palette := range palettes {
+		PaletteMap[palette.Name] = palette
+	}
+	return nil
 }
 
 func (p *Palette) Color(index int) color.Color {
 	return p.Colors[index]
 }
 
+// MixTable returns the color perceived for each pair of palette colors
+// shown in alternate frames, as used by interlaced modes
+func (p *Palette) MixTable() [][]color.Color {
+	table := make([][]color.Color, len(p.Colors))
+	for i, a := range p.Colors {
+		table[i] = make([]color.Color, len(p.Colors))
+		for j, b := range p.Colors {
+			table[i][j] = mixColors(a, b)
+		}
+	}
+	return table
+}
+
+// PaletteByName returns the palette with the given name, or read from the
+// given VICE .vpl file, defaulting to colodore if there is no such palette
 func PaletteByName(name string) *Palette {
+	if strings.HasSuffix(strings.ToLower(name), ".vpl") {
+		palette, err := LoadVPL(name)
+		if err != nil {
+			log.Printf("Could not read palette file: %v, defaulting to %q.\n", err, "colodore")
+			return PaletteMap["colodore"]
+		}
+		return palette
+	}
 	palette, ok := PaletteMap[name]
 	if !ok {
 		log.Printf("Invalid palette name %q, defaulting to %q.\n", name, "colodore")
@@ -70,35 +134,118 @@ func PaletteByName(name string) *Palette {
 	return palette
 }
 
-func PaletteBestMatch(colors []color.Color) *Palette {
+// OptionalPalette returns the palette with the given name, or nil to have
+// FromImage pick the best matching palette if the name is empty
+func OptionalPalette(name string) *Palette {
+	if len(name) == 0 {
+		return nil
+	}
+	return PaletteByName(name)
+}
+
+// PaletteBestMatch returns the palette whose colors are perceptually
+// closest to the given colors, measured as the mean CIEDE2000 difference
+// between each color and its nearest palette color. It also returns a
+// confidence from 0 to 1 in how clearly the palette beats the runner-up,
+// and the index of the nearest palette color for each of the colors,
+// warning about palette colors that several of them are mapped to.
+// A palette named FORCE always wins.
+func PaletteBestMatch(colors []color.Color) (*Palette, float64, []byte) {
+	names := make([]string, 0, len(PaletteMap))
+	for name := range PaletteMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	labs := labColors(colors)
 	var bestMatch *Palette
-	var bestScore = 0
-	for _, pal := range PaletteMap {
-		score := 0
-		for _, ccol := range colors {
-			for _, pcol := range pal.Colors {
-				if ccol == pcol {
-					score++
-				}
+	var bestMapping []byte
+	bestScore, secondScore := math.Inf(1), math.Inf(1)
+	for _, name := range names {
+		pal := PaletteMap[name]
+		mapping, score := pal.mapping(labs)
+		if pal.Name == "FORCE" {
+			score = -1
+		}
+		if score < bestScore {
+			secondScore = bestScore
+			bestScore, bestMatch, bestMapping = score, pal, mapping
+		} else if score < secondScore {
+			secondScore = score
+		}
+	}
+	if bestMatch == nil {
+		return nil, 0, nil
+	}
+	confidence := 1.0
+	if bestScore > 0 && !math.IsInf(secondScore, 1) {
+		confidence = (secondScore - bestScore) / secondScore
+	}
+	fmt.Fprintf(os.Stderr, "Palette %q won with a mean difference of %.2f, confidence %.2f.\n", bestMatch.Name, math.Max(bestScore, 0), confidence)
+	warnSharedColors(colors, bestMapping, bestMatch)
+	return bestMatch, confidence, bestMapping
+}
+
+// Mapping returns the index of the nearest palette color for each of the
+// given colors by CIEDE2000 difference, along with the mean difference
+func (p *Palette) Mapping(colors []color.Color) ([]byte, float64) {
+	return p.mapping(labColors(colors))
+}
+
+func (p *Palette) mapping(labs [][3]float64) ([]byte, float64) {
+	own := labColors(p.Colors)
+	mapping := make([]byte, len(labs))
+	sum := 0.0
+	for i, c := range labs {
+		best := math.Inf(1)
+		for j, pc := range own {
+			d := ciede2000(c[0], c[1], c[2], pc[0], pc[1], pc[2])
+			if d < best {
+				best = d
+				mapping[i] = byte(j)
 			}
 		}
-		if pal.Name == "FORCE" {
-			score = 9999
+		sum += best
+	}
+	if len(labs) == 0 {
+		return mapping, 0
+	}
+	return mapping, sum / float64(len(labs))
+}
+
+// warnSharedColors logs the palette colors that more than one of the
+// given colors are mapped to, or just how many colors were merged if
+// there are more colors than the palette has
+func warnSharedColors(colors []color.Color, mapping []byte, palette *Palette) {
+	if len(colors) > len(palette.Colors) {
+		log.Printf("%d colors mapped to the %d colors of palette %q", len(colors), len(palette.Colors), palette.Name)
+		return
+	}
+	for index := range palette.Colors {
+		shared := []string{}
+		for i, c := range colors {
+			if int(mapping[i]) == index {
+				shared = append(shared, hexString(c))
+			}
 		}
-		if score > bestScore {
-			bestScore = score
-			bestMatch = pal
+		if len(shared) > 1 {
+			log.Printf("Colors %s all map to VIC color %d", strings.Join(shared, ", "), index)
 		}
 	}
-	fmt.Printf("Palette %q won with a score of %d.\n", bestMatch.Name, bestScore)
-	return bestMatch
+}
+
+// labColors converts colors to CIELAB
+func labColors(colors []color.Color) [][3]float64 {
+	labs := make([][3]float64, len(colors))
+	for i, c := range colors {
+		labs[i][0], labs[i][1], labs[i][2] = lab(c)
+	}
+	return labs
 }
 
 func MakePalette(name string, values ...string) *Palette {
-	valueStr := strings.Join(values, ":")
-	colors := make([]color.Color, 16)
-	for i, value := range strings.Split(valueStr, ":") {
-		colors[i] = hexColor(value)
+	colors, err := parseColorList(splitColorList(strings.Join(values, ":")))
+	if err != nil {
+		panic(err)
 	}
 	palette := &Palette{Name: name, Colors: colors}
 	_, exists := PaletteMap[name]
@@ -108,10 +255,29 @@ func MakePalette(name string, values ...string) *Palette {
 	return palette
 }
 
-func hexColor(value string) color.Color {
-	rgb, err := hex.DecodeString(value)
-	if err != nil {
-		panic(err)
+// splitColorList splits a list of colors separated by colons or commas
+func splitColorList(list string) []string {
+	return strings.Split(strings.Replace(list, ",", ":", -1), ":")
+}
+
+// parseColorList parses 16 hex colors
+func parseColorList(values []string) ([]color.Color, error) {
+	if len(values) != 16 {
+		return nil, fmt.Errorf("expected 16 colors, got %d", len(values))
+	}
+	colors := make([]color.Color, 16)
+	for i, value := range values {
+		rgb, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(value), "#"))
+		if err != nil || len(rgb) != 3 {
+			return nil, fmt.Errorf("invalid color %q", value)
+		}
+		colors[i] = color.RGBA{rgb[0], rgb[1], rgb[2], 255}
 	}
-	return color.RGBA{rgb[0], rgb[1], rgb[2], 255}
+	return colors, nil
+}
+
+// hexString returns a color as #rrggbb
+func hexString(c color.Color) string {
+	r, g, b := rgb(c)
+	return fmt.Sprintf("#%02x%02x%02x", int(r), int(g), int(b))
 }
@@ -0,0 +1,149 @@
+package gfx
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ColorNames holds the name of each color index
+var ColorNames = []string{
+	"Black", "White", "Red", "Cyan", "Purple", "Green", "Blue", "Yellow",
+	"Orange", "Brown", "Light Red", "Dark Grey", "Medium Grey", "Light Green", "Light Blue", "Light Grey",
+}
+
+// PaletteFormats lists the formats Export can write, by file extension
+var PaletteFormats = []string{"gpl", "act", "txt", "json", "hex", "vpl"}
+
+// ParseVPL reads a VICE palette file, with a line of hex red, green and
+// blue values and an optional dither value for each color, and comments
+// starting with #
+func ParseVPL(r io.Reader, name string) (*Palette, error) {
+	colors := []color.Color{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = strings.TrimSpace(text[:i])
+		}
+		if len(text) == 0 {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: expected red, green and blue values", line)
+		}
+		var rgb [3]uint8
+		for i := range rgb {
+			v, err := strconv.ParseUint(fields[i], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid value %q", line, fields[i])
+			}
+			rgb[i] = uint8(v)
+		}
+		colors = append(colors, color.RGBA{rgb[0], rgb[1], rgb[2], 255})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(colors) != 16 {
+		return nil, fmt.Errorf("expected 16 colors, got %d", len(colors))
+	}
+	return &Palette{Name: name, Colors: colors}, nil
+}
+
+// LoadVPL reads a VICE palette file and adds it to PaletteMap, named
+// after the file without extension, replacing any palette of that name
+func LoadVPL(filename string) (*Palette, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	name := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	palette, err := ParseVPL(f, name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	PaletteMap[name] = palette
+	return palette, nil
+}
+
+// Export writes the palette in one of PaletteFormats: GIMP (gpl),
+// Photoshop (act), Paint.NET (txt), a JSON object in the palette config
+// format (json), one hex color per line (hex) or VICE (vpl)
+func (p *Palette) Export(w io.Writer, format string) error {
+	var err error
+	switch format {
+	case "gpl":
+		_, err = fmt.Fprintf(w, "GIMP Palette\nName: %s\nColumns: 8\n#\n", p.Name)
+		for i, c := range p.Colors {
+			r, g, b := rgb(c)
+			if err == nil {
+				_, err = fmt.Fprintf(w, "%3d %3d %3d\t%s\n", int(r), int(g), int(b), p.colorName(i))
+			}
+		}
+	case "act":
+		data := make([]byte, 772)
+		for i, c := range p.Colors {
+			r, g, b := rgb(c)
+			data[i*3], data[i*3+1], data[i*3+2] = byte(r), byte(g), byte(b)
+		}
+		data[768], data[769], data[770], data[771] = 0, byte(len(p.Colors)), 0xFF, 0xFF
+		_, err = w.Write(data)
+	case "txt":
+		_, err = fmt.Fprintf(w, "; paint.net Palette File\n; Palette: %s\n; Colors: %d\n", p.Name, len(p.Colors))
+		for _, c := range p.Colors {
+			if err == nil {
+				_, err = fmt.Fprintf(w, "FF%s\n", strings.ToUpper(hexString(c)[1:]))
+			}
+		}
+	case "json":
+		values := []string{}
+		for _, c := range p.Colors {
+			values = append(values, strings.ToUpper(hexString(c)[1:]))
+		}
+		var data []byte
+		data, err = json.MarshalIndent(map[string]string{p.Name: strings.Join(values, ",")}, "", "  ")
+		if err == nil {
+			_, err = fmt.Fprintf(w, "%s\n", data)
+		}
+	case "hex":
+		for _, c := range p.Colors {
+			if err == nil {
+				_, err = fmt.Fprintln(w, hexString(c))
+			}
+		}
+	case "vpl":
+		_, err = fmt.Fprintf(w, "#\n# VICE Palette file\n#\n# Syntax:\n# Red Green Blue Dither\n#\n")
+		for i, c := range p.Colors {
+			r, g, b := rgb(c)
+			if err == nil {
+				_, err = fmt.Fprintf(w, "\n# %s\n%02X %02X %02X %X\n", p.colorName(i), int(r), int(g), int(b), vplDither(c))
+			}
+		}
+	default:
+		return fmt.Errorf("Unknown palette format %q", format)
+	}
+	return err
+}
+
+func (p *Palette) colorName(index int) string {
+	if index < len(ColorNames) {
+		return ColorNames[index]
+	}
+	return fmt.Sprintf("Color %d", index)
+}
+
+// vplDither returns the dither value VICE expects for a color, a rough
+// luminance level from 0 to 15
+func vplDither(c color.Color) int {
+	r, g, b := rgb(c)
+	return int((0.299*r + 0.587*g + 0.114*b) / 256 * 16)
+}
@@ -0,0 +1,60 @@
+package gfx
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVPLRoundTrip(t *testing.T) {
+	for _, name := range []string{"colodore", "pepto", "vice"} {
+		palette := PaletteMap[name]
+		var out bytes.Buffer
+		if err := palette.Export(&out, "vpl"); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		parsed, err := ParseVPL(bytes.NewReader(out.Bytes()), name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(parsed, palette) {
+			t.Errorf("%s: parsed palette differs", name)
+		}
+		var again bytes.Buffer
+		if err := parsed.Export(&again, "vpl"); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(again.Bytes(), out.Bytes()) {
+			t.Errorf("%s: bytes differ after round trip", name)
+		}
+	}
+}
+
+func TestParseVPL(t *testing.T) {
+	vpl := "# VICE Palette file\n\n" + strings.Repeat("00 00 00 0  # black\n", 15) + "ff 80 0a f\n"
+	palette, err := ParseVPL(strings.NewReader(vpl), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b := rgb(palette.Colors[15]); r != 255 || g != 128 || b != 10 {
+		t.Errorf("color 15 is %v, %v, %v, want 255, 128, 10", r, g, b)
+	}
+	if _, err := ParseVPL(strings.NewReader("00 00 00 0\n"), "short"); err == nil {
+		t.Error("expected error for a single color")
+	}
+	if _, err := ParseVPL(strings.NewReader(strings.Repeat("00 00 zz 0\n", 16)), "bad"); err == nil {
+		t.Error("expected error for invalid value")
+	}
+}
+
+func TestExportACT(t *testing.T) {
+	var out bytes.Buffer
+	if err := PaletteMap["colodore"].Export(&out, "act"); err != nil {
+		t.Fatal(err)
+	}
+	data := out.Bytes()
+	if len(data) != 772 || data[769] != 16 {
+		t.Errorf("got %d bytes with %d colors, want 772 bytes with 16 colors", len(data), data[769])
+	}
+}
@@ -0,0 +1,91 @@
+package gfx
+
+import (
+	"image/color"
+	"math"
+)
+
+// PaletteParams are the monitor settings and machine type used to
+// generate a palette from the luma and chroma signals of the VIC-II.
+// Brightness and saturation go from 0 to 100 and contrast from 0 to 200,
+// the colodore palette using 50, 100 and 50, and Gamma is the gamma of the
+// display the palette is shown on.
+type PaletteParams struct {
+	Brightness  float64
+	Contrast    float64
+	Saturation  float64
+	Gamma       float64
+	OldRevision bool
+	NTSC        bool
+}
+
+// DefaultPaletteParams gives the colodore palette for a new PAL VIC-II
+var DefaultPaletteParams = PaletteParams{
+	Brightness: 50,
+	Contrast:   100,
+	Saturation: 50,
+	Gamma:      2.2,
+}
+
+// Luma levels of each color for the first and later VIC-II revisions
+var (
+	lumaOld = []float64{0, 32, 8, 24, 16, 16, 8, 24, 16, 8, 16, 8, 16, 24, 16, 24}
+	lumaNew = []float64{0, 32, 10, 20, 12, 16, 8, 24, 12, 8, 16, 10, 15, 24, 15, 20}
+)
+
+// Chroma angle of each color in sectors of 22.5 degrees, 0 for the grey
+// colors which have no chroma
+var chromaAngles = []float64{0, 0, 4, 12, 2, 10, 15, 7, 5, 6, 4, 0, 0, 10, 15, 0}
+
+// Gamma of the signal sent by PAL and NTSC machines
+const (
+	palGamma  = 2.8
+	ntscGamma = 2.2
+)
+
+// GeneratePalette computes the 16 VIC-II colors as YUV from their luma
+// levels and chroma angles, adjusted by the monitor settings, and
+// converts them to RGB gamma corrected for the display
+func GeneratePalette(name string, params PaletteParams) *Palette {
+	const sector = 360.0 / 16
+	const screen = 1.0 / 5
+	luma := lumaNew
+	if params.OldRevision {
+		luma = lumaOld
+	}
+	source := palGamma
+	if params.NTSC {
+		source = ntscGamma
+	}
+	brightness := params.Brightness - 50
+	contrast := params.Contrast/100 + screen
+	saturation := params.Saturation * (1 - screen)
+
+	colors := make([]color.Color, 16)
+	for i := range colors {
+		y := (8*luma[i] + brightness) * contrast
+		u, v := 0.0, 0.0
+		if chromaAngles[i] != 0 {
+			angle := radians(sector/2 + chromaAngles[i]*sector)
+			u = math.Cos(angle) * saturation * contrast
+			v = math.Sin(angle) * saturation * contrast
+		}
+		r := y + 1.140*v
+		g := y - 0.396*u - 0.581*v
+		b := y + 2.029*u
+		colors[i] = color.RGBA{
+			gammaCorrect(r, source, params.Gamma),
+			gammaCorrect(g, source, params.Gamma),
+			gammaCorrect(b, source, params.Gamma),
+			255,
+		}
+	}
+	return &Palette{Name: name, Colors: colors}
+}
+
+// gammaCorrect converts a color component from the source gamma to the
+// target gamma, clamping it to 0-255
+func gammaCorrect(value, source, target float64) uint8 {
+	value = math.Min(math.Max(value, 0), 255) / 255
+	return uint8(math.Round(255 * math.Pow(value, source/target)))
+}
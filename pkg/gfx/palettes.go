@@ -0,0 +1,12 @@
+package gfx
+
+// builtinPalettes holds the palettes that are always available, unless
+// replaced by a palette config file
+var builtinPalettes = map[string]string{
+	"colodore": "000000,FFFFFF,813338,75CEC8,8E3C97,56AC4D,2E2C9B,EDF171,8E5029,553800,C46C71,4A4A4A,7B7B7B,A9FF9F,706DEB,B2B2B2",
+	"pepto":    "000000,FFFFFF,68372B,70A4B2,6F3D86,588D43,352879,B8C76F,6F4F25,433900,9A6759,444444,6C6C6C,9AD284,6C5EB5,959595",
+	"levy":     "000000,FFFFFF,8B4131,7BBDC6,8B41AC,6AAC41,3931A4,D5DE73,945A20,5A4100,BD736A,525252,838383,ACEE8B,7B73DE,ACACAC",
+	"vice":     "000000,FFFFFF,883932,67B6BD,8B3F96,55A049,40318D,BFCE72,8B5429,574200,B86962,505050,787878,94E089,7869C4,9F9F9F",
+	"vice_new": "000000,FFFFFF,68372B,70A4B2,6F3D86,588D43,352879,B8C76F,6F4F25,433900,9A6759,444444,6C6C6C,9AD284,6C5EB5,959595",
+	"vice_old": "000000,FDFEFC,BE1A24,30E6C6,B41AE2,1FD21E,211BAE,DFF60A,B84104,6A3304,FE4A57,424540,70746F,59FE59,5F53FE,A4A7A2",
+}
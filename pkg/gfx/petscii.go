@@ -0,0 +1,127 @@
+package gfx
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// Petscii represents a 40x25 text screen of screen codes and colors shown
+// with a character ROM on a global background color
+type Petscii struct {
+	Screen  []byte
+	Colors  []byte
+	BgColor byte
+	Error   float64
+}
+
+// Bytes returns the screen followed by the colors packed two per byte and
+// the background color, the layout written by mempetscii
+func (petscii *Petscii) Bytes() []byte {
+	data := append([]byte{}, petscii.Screen...)
+	for i := 0; i < len(petscii.Colors); i += 2 {
+		data = append(data, (petscii.Colors[i]&15)*16+(petscii.Colors[i+1]&15))
+	}
+	return append(data, petscii.BgColor&15)
+}
+
+// TextScreen returns the screen as a standard text screen shown with the
+// given charset
+func (petscii *Petscii) TextScreen(charset []byte) *TextScreen {
+	return &TextScreen{
+		Screen:   petscii.Screen,
+		Colors:   petscii.Colors,
+		Charset:  charset,
+		BgColors: [4]byte{petscii.BgColor},
+		Mode:     StandardText,
+		Width:    40,
+		Height:   25}
+}
+
+// ParsePetscii reads a screen in the layout written by Bytes, with or
+// without load address
+func ParsePetscii(r io.Reader) (*Petscii, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 1503 {
+		data = data[2:]
+	}
+	if len(data) != 1501 {
+		return nil, fmt.Errorf("Unexpected size of PETSCII data: %d bytes", len(data))
+	}
+	petscii := Petscii{
+		Screen:  data[0:1000],
+		Colors:  make([]byte, 1000),
+		BgColor: data[1500] & 15}
+	for i, value := range data[1000:1500] {
+		petscii.Colors[i*2], petscii.Colors[i*2+1] = value>>4, value&15
+	}
+	return &petscii, nil
+}
+
+// ReadCharset reads 256 chars from a character ROM or charset file, with
+// or without load address. Files of 4096 bytes or more hold several sets,
+// of which the given one is returned.
+func ReadCharset(filename string, set int) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%2048 == 2 {
+		data = data[2:]
+	}
+	if len(data) < 2048 || len(data)%2048 != 0 {
+		return nil, fmt.Errorf("File %s does not look like a charset (%d bytes)", filename, len(data))
+	}
+	if set < 0 || (set+1)*2048 > len(data) {
+		return nil, fmt.Errorf("File %s has no charset number %d", filename, set)
+	}
+	return data[set*2048 : (set+1)*2048], nil
+}
+
+// Petscii matches each 8x8 cell of the 320x200 hires image at the given
+// offset against the 256 chars of the charset, picking the char and
+// foreground color that show the source pixels with the least error on
+// the background color of the image
+func (image *Image) Petscii(xoffset, yoffset int, charset []byte) *Petscii {
+	petscii := Petscii{Screen: make([]byte, 1000), Colors: make([]byte, 1000), BgColor: image.BgColor}
+	for i := range petscii.Screen {
+		samples := image.sourceSamples(xoffset+(i%40)*8, yoffset+(i/40)*8, 8, 8)
+		// distances[p][c] is the distance from source pixel p to color c,
+		// less the distance to the background color
+		distances := make([][]float64, 64)
+		base := 0.0
+		for p, sample := range samples {
+			distances[p] = make([]float64, len(image.palette))
+			bg := image.distance(sample, image.palette[image.BgColor])
+			base += bg
+			for c, pc := range image.palette {
+				distances[p][c] = image.distance(sample, pc) - bg
+			}
+		}
+		best := math.Inf(1)
+		for code := 0; code < 256; code++ {
+			set := []int{}
+			for p := range distances {
+				if (charset[code*8+p/8]>>uint(7-p%8))&1 == 1 {
+					set = append(set, p)
+				}
+			}
+			for c := range image.palette {
+				sum := base
+				for _, p := range set {
+					sum += distances[p][c]
+				}
+				if sum < best {
+					best = sum
+					petscii.Screen[i], petscii.Colors[i] = byte(code), byte(c)
+				}
+			}
+		}
+		petscii.Error += best
+	}
+	return &petscii
+}
@@ -0,0 +1,36 @@
+package gfx
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestPetsciiRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	petscii := &Petscii{
+		Screen:  randomBytes(rng, 1000, 256),
+		Colors:  randomBytes(rng, 1000, 16),
+		BgColor: 14}
+	data := petscii.Bytes()
+	if len(data) != 1501 {
+		t.Fatalf("got %d bytes, want 1501", len(data))
+	}
+	for _, file := range [][]byte{data, withLoadAddress(0x0400, data)} {
+		parsed, err := ParsePetscii(bytes.NewReader(file))
+		if err != nil {
+			t.Errorf("%d bytes: %v", len(file), err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed, petscii) {
+			t.Errorf("%d bytes: parsed screen differs", len(file))
+		}
+		if !bytes.Equal(parsed.Bytes(), data) {
+			t.Errorf("%d bytes: bytes differ after round trip", len(file))
+		}
+	}
+	if _, err := ParsePetscii(bytes.NewReader(make([]byte, 1000))); err == nil {
+		t.Error("expected error for 1000 bytes")
+	}
+}
@@ -0,0 +1,222 @@
+package gfx
+
+import (
+	"math"
+	"sort"
+)
+
+// ColorScore describes how well a choice of shared colors suits an image,
+// as the number of cells that would clash and the total distance between
+// the pixels of those cells and the colors they would be remapped to
+type ColorScore struct {
+	Colors  []byte
+	Clashes int
+	Error   float64
+}
+
+// RankBackgrounds evaluates each color as background color for a
+// 160x200 multicolor bitmap at the given offset and returns the scores,
+// best first
+func (image *Image) RankBackgrounds(xoffset, yoffset int) []ColorScore {
+	cells := image.cellHistograms(xoffset, yoffset, 40, 25)
+	table := image.distanceTable()
+	scores := []ColorScore{}
+	for bg := 0; bg < len(image.palette); bg++ {
+		scores = append(scores, scoreColors(cells, table, []byte{byte(bg)}, 3, 16))
+	}
+	sortScores(scores)
+	return scores
+}
+
+// RankCharBackgrounds evaluates each color as background color of a
+// charset covering cols x rows chars at the given offset and returns the
+// scores, best first. Each hires char may use one other color, and each
+// multicolor char the shared multicolors set by SetMultiColors and one
+// other color below 8.
+func (image *Image) RankCharBackgrounds(xoffset, yoffset, cols, rows int) []ColorScore {
+	cells := image.cellHistograms(xoffset, yoffset, cols, rows)
+	table := image.distanceTable()
+	shared, limit := []byte{0}, byte(16)
+	if image.mcol {
+		if image.mColors == nil {
+			panic("Can't rank char backgrounds before calling SetMultiColors.")
+		}
+		shared, limit = []byte{0, image.mColors[0], image.mColors[1]}, 8
+	}
+	scores := []ColorScore{}
+	for bg := 0; bg < len(image.palette); bg++ {
+		shared[0] = byte(bg)
+		score := scoreColors(cells, table, shared, 1, limit)
+		score.Colors = score.Colors[:1]
+		scores = append(scores, score)
+	}
+	sortScores(scores)
+	return scores
+}
+
+// RankMultiColors evaluates each combination of three colors as the
+// shared colors of a multicolor charset covering cols x rows chars at the
+// given offset, where each char may also use one color below 8 from color
+// RAM, and returns the scores, best first. The first color of each
+// combination is the one used most, to be used as background color, and
+// the other three are in the order expected by SetMultiColors, the last
+// one being the color below 8 used most by the chars.
+func (image *Image) RankMultiColors(xoffset, yoffset, cols, rows int) []ColorScore {
+	cells := image.cellHistograms(xoffset, yoffset, cols, rows)
+	table := image.distanceTable()
+	totals := make([]int, len(image.palette))
+	for _, cell := range cells {
+		for c, n := range cell {
+			totals[c] += n
+		}
+	}
+	scores := []ColorScore{}
+	combinations(len(image.palette), 3, func(colors []byte) {
+		score := scoreColors(cells, table, colors, 1, 8)
+		sort.SliceStable(score.Colors, func(i, j int) bool {
+			return totals[score.Colors[i]] > totals[score.Colors[j]]
+		})
+		ram := -1
+		for c := 0; c < 8; c++ {
+			if !containsColor(score.Colors, byte(c)) && (ram < 0 || totals[c] > totals[ram]) {
+				ram = c
+			}
+		}
+		score.Colors = append(score.Colors, byte(ram))
+		scores = append(scores, score)
+	})
+	sortScores(scores)
+	return scores
+}
+
+// ChooseMultiColors sets the background color and the shared multicolors
+// of a charset covering cols x rows chars at the given offset to the best
+// combination ranked by RankMultiColors and returns its score. Unless
+// chooseBg is set, only combinations including the current background
+// color are considered.
+func (image *Image) ChooseMultiColors(xoffset, yoffset, cols, rows int, chooseBg bool) ColorScore {
+	for _, score := range image.RankMultiColors(xoffset, yoffset, cols, rows) {
+		colors := score.Colors
+		if chooseBg {
+			image.BgColor = colors[0]
+		}
+		for i, c := range colors[0:3] {
+			if c == image.BgColor {
+				others := append(append([]byte{}, colors[0:i]...), colors[i+1:]...)
+				image.SetMultiColors(others[0], others[1], others[2])
+				return score
+			}
+		}
+	}
+	return ColorScore{}
+}
+
+// cellHistograms returns the number of pixels of each color in each
+// cell of the given area, 4x8 pixels for multicolor images and 8x8 for
+// hires images
+func (image *Image) cellHistograms(xoffset, yoffset, cols, rows int) [][]int {
+	width := 8
+	if image.mcol {
+		width = 4
+	}
+	cells := [][]int{}
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			counts := make([]int, len(image.palette))
+			for c, n := range histogram(image.Pixels(xoffset+col*width, yoffset+row*8, width, 8)) {
+				counts[c] += n
+			}
+			cells = append(cells, counts)
+		}
+	}
+	return cells
+}
+
+// distanceTable returns the distance between each pair of palette colors
+func (image *Image) distanceTable() [][]float64 {
+	table := make([][]float64, len(image.palette))
+	for i, a := range image.palette {
+		table[i] = make([]float64, len(image.palette))
+		for j, b := range image.palette {
+			table[i][j] = image.distance(a, b)
+		}
+	}
+	return table
+}
+
+// scoreColors scores the shared colors for cells that may each also use
+// up to free other colors below limit. A clashing cell with fewer such
+// colors than free is scored using all of them.
+func scoreColors(cells [][]int, table [][]float64, shared []byte, free int, limit byte) ColorScore {
+	score := ColorScore{Colors: append([]byte{}, shared...)}
+	for _, counts := range cells {
+		extra := []byte{}
+		clash := false
+		for c, n := range counts {
+			if n > 0 && !containsColor(shared, byte(c)) {
+				if byte(c) < limit {
+					extra = append(extra, byte(c))
+				} else {
+					clash = true
+				}
+			}
+		}
+		if len(extra) <= free && !clash {
+			continue
+		}
+		score.Clashes++
+		best := math.Inf(1)
+		k := free
+		if len(extra) < k {
+			k = len(extra)
+		}
+		combinations(len(extra), k, func(chosen []byte) {
+			colors := append([]byte{}, shared...)
+			for _, i := range chosen {
+				colors = append(colors, extra[i])
+			}
+			total := 0.0
+			for c, n := range counts {
+				if n == 0 {
+					continue
+				}
+				nearest := math.Inf(1)
+				for _, cc := range colors {
+					nearest = math.Min(nearest, table[c][cc])
+				}
+				total += float64(n) * nearest
+			}
+			best = math.Min(best, total)
+		})
+		score.Error += best
+	}
+	return score
+}
+
+// combinations calls f with each ascending combination of k of the
+// numbers 0 to n-1
+func combinations(n, k int, f func([]byte)) {
+	chosen := make([]byte, 0, k)
+	var next func(start int)
+	next = func(start int) {
+		if len(chosen) == k {
+			f(chosen)
+			return
+		}
+		for i := start; i < n; i++ {
+			chosen = append(chosen, byte(i))
+			next(i + 1)
+			chosen = chosen[:len(chosen)-1]
+		}
+	}
+	next(0)
+}
+
+func sortScores(scores []ColorScore) {
+	sort.SliceStable(scores, func(i, j int) bool {
+		if scores[i].Clashes != scores[j].Clashes {
+			return scores[i].Clashes < scores[j].Clashes
+		}
+		return scores[i].Error < scores[j].Error
+	})
+}
@@ -0,0 +1,133 @@
+package gfx
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Color slots of a bitmap cell. In multicolor cells the screen high
+// nibble, low nibble and color RAM are used for bit pairs 01, 10 and 11.
+// In hires cells the screen high nibble is used for set bits and the
+// low nibble for cleared bits.
+const (
+	SlotScreenHigh = iota
+	SlotScreenLow
+	SlotColorRAM
+)
+
+var SlotNames = map[string]int{
+	"hi":  SlotScreenHigh,
+	"lo":  SlotScreenLow,
+	"ram": SlotColorRAM,
+}
+
+// ParseColorSlots parses a comma separated list of color=slot pairs,
+// such as "6=ram,14=hi", into a map from color to slot. The color RAM
+// slot is only accepted for multicolor images.
+func ParseColorSlots(spec string, multicolor bool) (map[byte]int, error) {
+	slots := map[byte]int{}
+	if len(spec) == 0 {
+		return slots, nil
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.Split(pair, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid color slot %q, expected color=slot", pair)
+		}
+		c, err := strconv.Atoi(parts[0])
+		if err != nil || c < 0 || c > 15 {
+			return nil, fmt.Errorf("Invalid color %q in color slot %q", parts[0], pair)
+		}
+		slot, ok := SlotNames[parts[1]]
+		if !ok || (!multicolor && slot == SlotColorRAM) {
+			if !multicolor {
+				return nil, fmt.Errorf("Invalid slot %q in color slot %q, expected hi or lo", parts[1], pair)
+			}
+			return nil, fmt.Errorf("Invalid slot %q in color slot %q, expected hi, lo or ram", parts[1], pair)
+		}
+		slots[byte(c)] = slot
+	}
+	return slots, nil
+}
+
+// SetColorSlot makes color c use the given slot in every cell where it appears
+func (image *Image) SetColorSlot(c byte, slot int) {
+	if image.slots == nil {
+		image.slots = map[byte]int{}
+	}
+	image.slots[c] = slot
+}
+
+// assignSlots places each of the colors of a cell in one of the slots
+// given in order, honouring forced slots and, if KeepSlots is set, the
+// slot each color was given in previous cells, and counting the colors
+// for which that is not possible. It returns the color of each slot.
+func (image *Image) assignSlots(colors []byte, order []int) []byte {
+	if image.KeepSlots && image.kept == nil {
+		image.kept = map[byte]int{}
+	}
+	slots := make([]int, len(order))
+	for i := range slots {
+		slots[i] = -1
+	}
+	placed := map[byte]bool{}
+	for i, preferred := range []map[byte]int{image.slots, image.kept} {
+		for _, c := range colors {
+			slot, found := preferred[c]
+			if !found || placed[c] {
+				continue
+			}
+			if slot < len(slots) && slots[slot] < 0 {
+				slots[slot] = int(c)
+				placed[c] = true
+			} else {
+				image.misses[i]++
+			}
+		}
+	}
+	for _, c := range colors {
+		if placed[c] {
+			continue
+		}
+		for _, slot := range order {
+			if slots[slot] < 0 {
+				slots[slot] = int(c)
+				break
+			}
+		}
+	}
+
+	assigned := make([]byte, len(slots))
+	for slot, c := range slots {
+		if c < 0 {
+			c = image.slotFiller(slot)
+		} else if _, exists := image.kept[byte(c)]; image.KeepSlots && !exists {
+			image.kept[byte(c)] = slot
+		}
+		assigned[slot] = byte(c)
+	}
+	return assigned
+}
+
+// WriteSlotReport writes how many times a color could not be given its
+// locked slot, or its kept slot if KeepSlots is set, to w
+func (image *Image) WriteSlotReport(w io.Writer) {
+	for i, kind := range []string{"locked", "kept"} {
+		if image.misses[i] > 0 {
+			fmt.Fprintf(w, "Colors could not use their %s slot %d times\n", kind, image.misses[i])
+		}
+	}
+}
+
+// slotFiller returns the color to put in an unused slot, which is the
+// lowest color forced into that slot, or 0 if there is none
+func (image *Image) slotFiller(slot int) int {
+	for c := 0; c < 16; c++ {
+		if s, forced := image.slots[byte(c)]; forced && s == slot {
+			return c
+		}
+	}
+	return 0
+}
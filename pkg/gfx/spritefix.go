@@ -0,0 +1,214 @@
+package gfx
+
+import (
+	"bytes"
+	img "image"
+	"sort"
+)
+
+// SpriteFix represents hires sprites placed over a bitmap to show pixels
+// of clashing cells in their source colors. X and Y are picture
+// coordinates of the top left corner of each sprite, Numbers the hardware
+// sprite each one is shown with, sprites sharing a number being
+// multiplexed. Unfixed counts the pixels no sprite could be placed for.
+type SpriteFix struct {
+	Sprites [][]byte
+	X       []int
+	Y       []int
+	Colors  []byte
+	Numbers []int
+	Unfixed int
+}
+
+// Bytes returns the sprites as raw 64-byte blocks
+func (fix *SpriteFix) Bytes() []byte {
+	return bytes.Join(fix.Sprites, []byte{})
+}
+
+// Table returns the multiplexing table of the sprites, which are sorted
+// by Y, as five tables each with one byte for each sprite: the hardware
+// sprite number, the low byte of the X position, the high bit of the X
+// position, the Y position and the color. Positions are given in VIC-II
+// coordinates for a picture shown in the top left corner of the screen.
+func (fix *SpriteFix) Table() []byte {
+	n := len(fix.Sprites)
+	table := make([]byte, n*5)
+	for i := 0; i < n; i++ {
+		x, y := fix.X[i]+24, fix.Y[i]+50
+		table[i] = byte(fix.Numbers[i])
+		table[n+i] = byte(x & 0xFF)
+		table[n*2+i] = byte(x >> 8)
+		table[n*3+i] = byte(y)
+		table[n*4+i] = fix.Colors[i]
+	}
+	return table
+}
+
+// Pointers returns the sprite pointer of each sprite, for sprites stored
+// from address in the VIC bank starting at bank
+func (fix *SpriteFix) Pointers(address, bank int) []byte {
+	pointers := make([]byte, len(fix.Sprites))
+	for i := range pointers {
+		pointers[i] = byte((address-bank)/64 + i)
+	}
+	return pointers
+}
+
+// Render returns a copy of the rendered bitmap with the sprites shown in
+// front of it
+func (fix *SpriteFix) Render(bitmap *img.Paletted) *img.Paletted {
+	rendered := img.NewPaletted(bitmap.Bounds(), bitmap.Palette)
+	copy(rendered.Pix, bitmap.Pix)
+	for i, spr := range fix.Sprites {
+		for y := 0; y < 21; y++ {
+			for x := 0; x < 24; x++ {
+				if (spr[y*3+x/8]>>uint(7-x%8))&1 == 1 {
+					rendered.SetColorIndex(fix.X[i]+x, fix.Y[i]+y, fix.Colors[i])
+				}
+			}
+		}
+	}
+	return rendered
+}
+
+// FixClashes places hires sprites over the clashing cells of the bitmap
+// rendered from the image, showing their pixels that differ from the
+// source in the source colors. Each sprite is placed to cover the first
+// such pixel left in raster order and as many others of the same color
+// as possible, as long as no raster line gets more than 8 sprites and no
+// more than maxSprites sprites are used in total, if maxSprites is
+// positive. The bitmap must have been converted from the given offset,
+// and sprite positions are relative to its top left corner.
+func (image *Image) FixClashes(bitmap *img.Paletted, xoffset, yoffset, maxSprites int) *SpriteFix {
+	bounds := bitmap.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	cellWidth := 8
+	// scale converts image x-coordinates to bitmap pixels
+	scale := 1
+	if image.mcol {
+		scale = 2
+	}
+	// wrong holds the source color of each pixel to fix, or -1
+	wrong := make([]int, width*height)
+	for i := range wrong {
+		wrong[i] = -1
+	}
+	for _, clash := range image.Clashes {
+		x0, y0 := (clash.X-xoffset)*scale, clash.Y-yoffset
+		for y := y0; y < y0+8 && y < height; y++ {
+			for x := x0; x < x0+cellWidth && x < width; x++ {
+				if x < 0 || y < 0 {
+					continue
+				}
+				c := image.sourceColor(x+xoffset*scale, y+yoffset)
+				if c != bitmap.ColorIndexAt(bounds.Min.X+x, bounds.Min.Y+y) {
+					wrong[y*width+x] = int(c)
+				}
+			}
+		}
+	}
+
+	fix := SpriteFix{Sprites: [][]byte{}, X: []int{}, Y: []int{}, Colors: []byte{}}
+	lines := make([]int, height+21)
+	covered := func(sx, sy int, c int) int {
+		n := 0
+		for y := sy; y < sy+21; y++ {
+			for x := sx; x < sx+24; x++ {
+				if x >= 0 && x < width && y >= 0 && y < height && wrong[y*width+x] == c {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	fits := func(sy int) bool {
+		for y := sy; y < sy+21; y++ {
+			if y >= 0 && lines[y] >= 8 {
+				return false
+			}
+		}
+		return true
+	}
+	for i, c := range wrong {
+		if c < 0 {
+			continue
+		}
+		px, py := i%width, i/width
+		bestX, bestY, best := 0, 0, 0
+		if maxSprites <= 0 || len(fix.Sprites) < maxSprites {
+			for sy := py - 20; sy <= py; sy++ {
+				if sy < 0 || !fits(sy) {
+					continue
+				}
+				for sx := px - 23; sx <= px; sx++ {
+					if n := covered(sx, sy, c); n > best {
+						bestX, bestY, best = sx, sy, n
+					}
+				}
+			}
+		}
+		if best == 0 {
+			wrong[i] = -1
+			fix.Unfixed++
+			continue
+		}
+		spr := make([]byte, 64)
+		for y := 0; y < 21; y++ {
+			for x := 0; x < 24; x++ {
+				xx, yy := bestX+x, bestY+y
+				if xx >= 0 && xx < width && yy < height && wrong[yy*width+xx] == c {
+					spr[y*3+x/8] |= 1 << uint(7-x%8)
+					wrong[yy*width+xx] = -1
+				}
+			}
+			lines[bestY+y]++
+		}
+		fix.Sprites = append(fix.Sprites, spr)
+		fix.X = append(fix.X, bestX)
+		fix.Y = append(fix.Y, bestY)
+		fix.Colors = append(fix.Colors, byte(c))
+	}
+	fix.assignNumbers()
+	return &fix
+}
+
+// assignNumbers sorts the sprites by Y and gives each the first hardware
+// sprite that is free again by the time it starts
+func (fix *SpriteFix) assignNumbers() {
+	order := make([]int, len(fix.Sprites))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return fix.Y[order[i]] < fix.Y[order[j]] })
+	sorted := SpriteFix{Unfixed: fix.Unfixed}
+	var ends [8]int
+	for i := range ends {
+		ends[i] = -21
+	}
+	for _, i := range order {
+		number := 0
+		for n, end := range ends {
+			if end <= fix.Y[i] {
+				number = n
+				break
+			}
+		}
+		ends[number] = fix.Y[i] + 21
+		sorted.Sprites = append(sorted.Sprites, fix.Sprites[i])
+		sorted.X = append(sorted.X, fix.X[i])
+		sorted.Y = append(sorted.Y, fix.Y[i])
+		sorted.Colors = append(sorted.Colors, fix.Colors[i])
+		sorted.Numbers = append(sorted.Numbers, number)
+	}
+	*fix = sorted
+}
+
+// sourceColor returns the palette color nearest to the source pixel at
+// the given position, in source pixels
+func (image *Image) sourceColor(x, y int) byte {
+	if !img.Pt(x, y).In(image.img.Bounds()) {
+		return image.BgColor
+	}
+	c, _ := nearestColor(image.img.At(x, y), image.palette, image.distance)
+	return c
+}
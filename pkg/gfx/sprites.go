@@ -0,0 +1,191 @@
+package gfx
+
+import (
+	"bytes"
+)
+
+// SpriteSheet represents the sprites sliced from a grid, with Frames
+// holding the index in Sprites of each grid cell in row order, or -1 for
+// cells skipped for being empty, and Colors the sprite color of each
+// grid cell
+type SpriteSheet struct {
+	Sprites [][]byte
+	Frames  []int
+	Colors  []byte
+}
+
+// SpriteColors holds the colors of a set of sprites, the shared
+// multicolors for $D025 and $D026 and the individual color of each
+// sprite, along with the total error of the pixels that don't fit
+type SpriteColors struct {
+	Shared []byte
+	Sprite []byte
+	Error  float64
+}
+
+// Bytes returns the sprites as raw 64-byte blocks
+func (sheet *SpriteSheet) Bytes() []byte {
+	return bytes.Join(sheet.Sprites, []byte{})
+}
+
+// Pointers returns the sprite pointer of each frame that was not skipped,
+// for sprites stored from address in the VIC bank starting at bank
+func (sheet *SpriteSheet) Pointers(address, bank int) []byte {
+	pointers := []byte{}
+	for _, index := range sheet.Frames {
+		if index >= 0 {
+			pointers = append(pointers, byte((address-bank)/64+index))
+		}
+	}
+	return pointers
+}
+
+// SpriteColors returns the sprite color of each frame that was not skipped
+func (sheet *SpriteSheet) SpriteColors() []byte {
+	colors := []byte{}
+	for i, index := range sheet.Frames {
+		if index >= 0 {
+			colors = append(colors, sheet.Colors[i])
+		}
+	}
+	return colors
+}
+
+// HiresSprite extracts a hires sprite as a 64-byte array, with a bit set
+// for each pixel of the given color. Pixels of other colors than that and
+// the background color are remapped to the nearest of those and recorded
+// as a Clash.
+func (image *Image) HiresSprite(xoffset, yoffset int, color byte) []byte {
+	pixels := image.Pixels(xoffset, yoffset, 24, 21)
+	colors := []byte{image.BgColor, color}
+	image.remapSprite(xoffset, yoffset, pixels, colors)
+	return packSprite(spriteBits(pixels, colors), 1)
+}
+
+// ChooseSpriteColors picks the colors of the cols x rows sprites in a grid
+// at the given offset that leave the least error for pixels that don't
+// fit, the shared multicolors being picked for the whole set. Shared
+// multicolors that are given and a sprite color that is not negative are
+// used as they are.
+func (image *Image) ChooseSpriteColors(xoffset, yoffset, cols, rows int, shared []byte, color int) *SpriteColors {
+	sprites := image.spriteHistograms(xoffset, yoffset, cols, rows)
+	table := image.distanceTable()
+	candidates := []byte{}
+	for c := range image.palette {
+		if c == color || color < 0 {
+			candidates = append(candidates, byte(c))
+		}
+	}
+	if !image.mcol {
+		best := SpriteColors{}
+		best.Sprite, best.Error = bestSpriteColors(sprites, table, []byte{image.BgColor}, candidates)
+		return &best
+	}
+	if shared != nil {
+		best := SpriteColors{Shared: shared}
+		best.Sprite, best.Error = bestSpriteColors(sprites, table, []byte{image.BgColor, shared[0], shared[1]}, candidates)
+		return &best
+	}
+	var best *SpriteColors
+	combinations(len(image.palette), 2, func(shared []byte) {
+		if containsColor(shared, image.BgColor) {
+			return
+		}
+		colors, sum := bestSpriteColors(sprites, table, []byte{image.BgColor, shared[0], shared[1]}, candidates)
+		if best == nil || sum < best.Error {
+			best = &SpriteColors{Shared: append([]byte{}, shared...), Sprite: colors, Error: sum}
+		}
+	})
+	return best
+}
+
+// bestSpriteColors picks the candidate giving the least error for each
+// sprite when combined with the fixed colors
+func bestSpriteColors(sprites [][]int, table [][]float64, fixed, candidates []byte) ([]byte, float64) {
+	colors := make([]byte, len(sprites))
+	total := 0.0
+	for i, counts := range sprites {
+		best := -1.0
+		for _, c := range candidates {
+			if containsColor(fixed, c) && len(candidates) > 1 {
+				continue
+			}
+			sum := 0.0
+			for p, n := range counts {
+				if n == 0 {
+					continue
+				}
+				d := table[p][c]
+				for _, f := range fixed {
+					if table[p][f] < d {
+						d = table[p][f]
+					}
+				}
+				sum += d * float64(n)
+			}
+			if best < 0 || sum < best {
+				colors[i], best = c, sum
+			}
+		}
+		total += best
+	}
+	return colors, total
+}
+
+// spriteHistograms returns the number of pixels of each color in each
+// sprite of a grid
+func (image *Image) spriteHistograms(xoffset, yoffset, cols, rows int) [][]int {
+	width := 24
+	if image.mcol {
+		width = 12
+	}
+	sprites := [][]int{}
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			counts := make([]int, len(image.palette))
+			for c, n := range histogram(image.Pixels(xoffset+col*width, yoffset+row*21, width, 21)) {
+				counts[c] += n
+			}
+			sprites = append(sprites, counts)
+		}
+	}
+	return sprites
+}
+
+// SpriteSheet slices cols x rows sprites from a grid at the given offset,
+// using HiresSprite or MulticolorSprite with the given colors depending
+// on the image type. Empty sprites are left out if skipEmpty is set, and
+// repeated sprites are only stored once if skipDuplicates is set.
+func (image *Image) SpriteSheet(xoffset, yoffset, cols, rows int, colors *SpriteColors, skipEmpty, skipDuplicates bool) *SpriteSheet {
+	sheet := SpriteSheet{Sprites: [][]byte{}, Frames: []int{}, Colors: colors.Sprite}
+	width := 24
+	if image.mcol {
+		width = 12
+	}
+	indices := map[string]int{}
+	empty := make([]byte, 64)
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			var spr []byte
+			color := colors.Sprite[row*cols+col]
+			if image.mcol {
+				spr = image.MulticolorSprite(xoffset+col*width, yoffset+row*21,
+					[]byte{image.BgColor, colors.Shared[0], color, colors.Shared[1]})
+			} else {
+				spr = image.HiresSprite(xoffset+col*width, yoffset+row*21, color)
+			}
+			if skipEmpty && bytes.Equal(spr, empty) {
+				sheet.Frames = append(sheet.Frames, -1)
+				continue
+			}
+			index, found := indices[string(spr)]
+			if !found || !skipDuplicates {
+				index = len(sheet.Sprites)
+				indices[string(spr)] = index
+				sheet.Sprites = append(sheet.Sprites, spr)
+			}
+			sheet.Frames = append(sheet.Frames, index)
+		}
+	}
+	return &sheet
+}
@@ -0,0 +1,91 @@
+package gfx
+
+import (
+	img "image"
+)
+
+// TextMode is one of the text modes of the VIC-II
+type TextMode int
+
+// Text modes
+const (
+	StandardText TextMode = iota
+	MulticolorText
+	ExtendedColorText
+)
+
+// TextModeMap maps text mode names to text modes
+var TextModeMap = map[string]TextMode{
+	"standard": StandardText,
+	"multi":    MulticolorText,
+	"ecm":      ExtendedColorText,
+}
+
+// TextScreen represents a text screen of Width x Height screen codes with
+// a color RAM value each, shown with a charset of up to 256 chars in the
+// given mode. BgColors holds the values of $D021-$D024.
+type TextScreen struct {
+	Screen   []byte
+	Colors   []byte
+	Charset  []byte
+	BgColors [4]byte
+	Mode     TextMode
+	Width    int
+	Height   int
+}
+
+// ColorAt returns the color index of the hires pixel at x, y
+func (screen *TextScreen) ColorAt(x, y int) byte {
+	offset := (y/8)*screen.Width + x/8
+	code := int(screen.Screen[offset])
+	if screen.Mode == ExtendedColorText {
+		code &= 63
+	}
+	value := byte(0)
+	if i := code*8 + y%8; i < len(screen.Charset) {
+		value = screen.Charset[i]
+	}
+	return screen.pixelColor(value, screen.Colors[offset], screen.cellBackground(offset), x%8)
+}
+
+// cellBackground returns the background color of the cell at offset,
+// which in extended color mode is selected by its screen code
+func (screen *TextScreen) cellBackground(offset int) byte {
+	if screen.Mode == ExtendedColorText {
+		return screen.BgColors[screen.Screen[offset]>>6]
+	}
+	return screen.BgColors[0]
+}
+
+// pixelColor returns the color index of pixel x (0-7) of a char row with
+// the given value, shown with the given color RAM value and background
+func (screen *TextScreen) pixelColor(value, color, bg byte, x int) byte {
+	color &= 15
+	if screen.Mode == MulticolorText && color >= 8 {
+		switch (value >> uint(6-x/2*2)) & 3 {
+		case 0:
+			return screen.BgColors[0] & 15
+		case 1:
+			return screen.BgColors[1] & 15
+		case 2:
+			return screen.BgColors[2] & 15
+		}
+		return color & 7
+	}
+	if (value>>uint(7-x))&1 == 1 {
+		return color
+	}
+	return bg & 15
+}
+
+// Render returns the text screen as a paletted image using the given
+// palette, with each multicolor pixel two pixels wide
+func (screen *TextScreen) Render(palette *Palette) *img.Paletted {
+	rendered := img.NewPaletted(img.Rect(0, 0, screen.Width*8, screen.Height*8), palette.Colors)
+	for y := 0; y < screen.Height*8; y++ {
+		for x := 0; x < screen.Width*8; x++ {
+			rendered.SetColorIndex(x, y, screen.ColorAt(x, y))
+		}
+	}
+	return rendered
+}
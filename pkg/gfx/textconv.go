@@ -0,0 +1,351 @@
+package gfx
+
+import (
+	"math"
+)
+
+// textCell holds the distances from each source pixel of an 8x8 cell to
+// each palette color, and from each pair of adjacent pixels, covered by
+// the same multicolor pixel, to each palette color
+type textCell struct {
+	pixels [][]float64
+	pairs  [][]float64
+}
+
+// textCells returns the distances for each 8x8 cell of the given area
+func (image *Image) textCells(xoffset, yoffset, cols, rows int) []textCell {
+	cells := make([]textCell, cols*rows)
+	for i := range cells {
+		samples := image.sourceSamples(xoffset+(i%cols)*8, yoffset+(i/cols)*8, 8, 8)
+		cell := textCell{pixels: make([][]float64, 64), pairs: make([][]float64, 32)}
+		for p, sample := range samples {
+			cell.pixels[p] = make([]float64, len(image.palette))
+			for c, pc := range image.palette {
+				cell.pixels[p][c] = image.distance(sample, pc)
+			}
+		}
+		for q := range cell.pairs {
+			cell.pairs[q] = make([]float64, len(image.palette))
+			for c := range image.palette {
+				cell.pairs[q][c] = cell.pixels[q*2][c] + cell.pixels[q*2+1][c]
+			}
+		}
+		cells[i] = cell
+	}
+	return cells
+}
+
+// hiresCost returns the error of showing the cell with the two colors
+func (cell *textCell) hiresCost(bg, fg byte) float64 {
+	sum := 0.0
+	for _, d := range cell.pixels {
+		sum += math.Min(d[bg], d[fg])
+	}
+	return sum
+}
+
+// hiresChar returns the char showing the cell best with the two colors
+func (cell *textCell) hiresChar(bg, fg byte) []byte {
+	char := make([]byte, 8)
+	for p, d := range cell.pixels {
+		char[p/8] <<= 1
+		if d[fg] < d[bg] {
+			char[p/8]++
+		}
+	}
+	return char
+}
+
+// multicolorCost returns the error of showing the cell in multicolor with
+// the four colors
+func (cell *textCell) multicolorCost(colors []byte) float64 {
+	sum := 0.0
+	for _, d := range cell.pairs {
+		best := d[colors[0]]
+		for _, c := range colors[1:] {
+			best = math.Min(best, d[c])
+		}
+		sum += best
+	}
+	return sum
+}
+
+// multicolorChar returns the char showing the cell best in multicolor
+// with the colors for bit pairs 00, 01, 10 and 11
+func (cell *textCell) multicolorChar(colors []byte) []byte {
+	char := make([]byte, 8)
+	for q, d := range cell.pairs {
+		bits := 0
+		for i, c := range colors {
+			if d[c] < d[colors[bits]] {
+				bits = i
+			}
+		}
+		char[q/4] = (char[q/4] << 2) + byte(bits)
+	}
+	return char
+}
+
+// ECMText converts the cols x rows cells at the given offset to extended
+// color mode, picking the four background colors that give the least
+// error and a background and foreground color for each cell. If more
+// than 64 chars are needed, the ones costing least are merged by the
+// color error of the pixels that change, and the changed cells are
+// returned.
+func (image *Image) ECMText(xoffset, yoffset, cols, rows int) (*TextScreen, []CharChange) {
+	cells := image.textCells(xoffset, yoffset, cols, rows)
+	n := len(image.palette)
+	// bests[i][bg] is the least error of cell i with background color bg
+	bests := make([][]float64, len(cells))
+	fgs := make([][]byte, len(cells))
+	for i := range cells {
+		bests[i], fgs[i] = make([]float64, n), make([]byte, n)
+		for bg := 0; bg < n; bg++ {
+			bests[i][bg] = math.Inf(1)
+			for fg := 0; fg < n; fg++ {
+				if d := cells[i].hiresCost(byte(bg), byte(fg)); d < bests[i][bg] {
+					bests[i][bg], fgs[i][bg] = d, byte(fg)
+				}
+			}
+		}
+	}
+	var bgColors []byte
+	best := math.Inf(1)
+	combinations(n, 4, func(colors []byte) {
+		sum := 0.0
+		for i := range cells {
+			d := bests[i][colors[0]]
+			for _, c := range colors[1:] {
+				d = math.Min(d, bests[i][c])
+			}
+			sum += d
+		}
+		if sum < best {
+			best, bgColors = sum, append([]byte{}, colors...)
+		}
+	})
+
+	screen := image.newTextScreen(cols, rows, ExtendedColorText, bgColors)
+	chars := make([][]byte, len(cells))
+	banks := make([]byte, len(cells))
+	for i := range cells {
+		for k, bg := range bgColors {
+			if bests[i][bg] < bests[i][bgColors[banks[i]]] {
+				banks[i] = byte(k)
+			}
+		}
+		bg := bgColors[banks[i]]
+		chars[i] = cells[i].hiresChar(bg, fgs[i][bg])
+		screen.Colors[i] = fgs[i][bg]
+	}
+	for i := range screen.Screen {
+		screen.Screen[i] = banks[i] << 6
+	}
+	changes := screen.setChars(xoffset, yoffset, chars, 64, image.distanceTable())
+	return screen, changes
+}
+
+// MixedText converts the cols x rows cells at the given offset to
+// multicolor text mode, showing each cell in hires or multicolor with a
+// color below 8 from color RAM, whichever gives less error. The three
+// shared colors are picked to give the least error. If more than 256
+// chars are needed, the ones costing least are merged with chars shown
+// in the same mode by the color error of the pixels that change, and the
+// changed cells are returned.
+func (image *Image) MixedText(xoffset, yoffset, cols, rows int) (*TextScreen, []CharChange) {
+	cells := image.textCells(xoffset, yoffset, cols, rows)
+	n := len(image.palette)
+	// hires[i][bg] is the least error of cell i in hires on bg
+	hires := make([][]float64, len(cells))
+	for i := range cells {
+		hires[i] = make([]float64, n)
+		for bg := 0; bg < n; bg++ {
+			hires[i][bg] = math.Inf(1)
+			for fg := 0; fg < 8; fg++ {
+				hires[i][bg] = math.Min(hires[i][bg], cells[i].hiresCost(byte(bg), byte(fg)))
+			}
+		}
+	}
+	var shared []byte
+	best := math.Inf(1)
+	multi := make([]float64, len(cells))
+	shown := make([]float64, 32)
+	combinations(n, 3, func(set []byte) {
+		for i, cell := range cells {
+			// Distance of each pair to the nearest of the shared colors
+			for q, d := range cell.pairs {
+				shown[q] = math.Min(d[set[0]], math.Min(d[set[1]], d[set[2]]))
+			}
+			multi[i] = math.Inf(1)
+			for fg := 0; fg < 8; fg++ {
+				sum := 0.0
+				for q, d := range cell.pairs {
+					sum += math.Min(shown[q], d[fg])
+				}
+				multi[i] = math.Min(multi[i], sum)
+			}
+		}
+		for k, bg := range set {
+			sum := 0.0
+			for i := range cells {
+				sum += math.Min(multi[i], hires[i][bg])
+			}
+			if sum < best {
+				best = sum
+				shared = []byte{bg}
+				for j, c := range set {
+					if j != k {
+						shared = append(shared, c)
+					}
+				}
+			}
+		}
+	})
+
+	screen := image.newTextScreen(cols, rows, MulticolorText, shared)
+	chars := make([][]byte, len(cells))
+	for i, cell := range cells {
+		bestHires, bestMulti := math.Inf(1), math.Inf(1)
+		var hiresFg, multiFg byte
+		for fg := byte(0); fg < 8; fg++ {
+			if d := cell.hiresCost(shared[0], fg); d < bestHires {
+				bestHires, hiresFg = d, fg
+			}
+			if d := cell.multicolorCost(append(shared[0:3:3], fg)); d < bestMulti {
+				bestMulti, multiFg = d, fg
+			}
+		}
+		if bestMulti < bestHires {
+			chars[i] = cell.multicolorChar(append(shared[0:3:3], multiFg))
+			screen.Colors[i] = multiFg | 8
+		} else {
+			chars[i] = cell.hiresChar(shared[0], hiresFg)
+			screen.Colors[i] = hiresFg
+		}
+	}
+	changes := screen.setChars(xoffset, yoffset, chars, 256, image.distanceTable())
+	return screen, changes
+}
+
+// newTextScreen returns an empty text screen with the given background
+// colors
+func (image *Image) newTextScreen(cols, rows int, mode TextMode, bgColors []byte) *TextScreen {
+	screen := TextScreen{
+		Screen: make([]byte, cols*rows),
+		Colors: make([]byte, cols*rows),
+		Mode:   mode,
+		Width:  cols,
+		Height: rows}
+	copy(screen.BgColors[:], bgColors)
+	return &screen
+}
+
+// charContext is a color RAM value and background color that a char is
+// shown with, and the number of cells showing it that way
+type charContext struct {
+	color, bg byte
+	count     int
+}
+
+// setChars sets the screen codes and charset for the given chars of each
+// cell, storing identical chars only once and keeping any bank bits of
+// extended color screen codes. If more than limit chars are needed, the
+// ones costing least are merged, only merging chars that are shown in the
+// same modes and scoring each merge by the color error of the pixels it
+// changes in the cells showing the char, and the changed cells are
+// returned.
+func (screen *TextScreen) setChars(xoffset, yoffset int, chars [][]byte, limit int, table [][]float64) []CharChange {
+	unique := [][]byte{}
+	indices := map[string]int{}
+	cells := make([]int, len(chars))
+	for i, char := range chars {
+		index, found := indices[string(char)]
+		if !found {
+			index = len(unique)
+			indices[string(char)] = index
+			unique = append(unique, char)
+		}
+		cells[i] = index
+	}
+	changes := []CharChange{}
+	final := make([]int, len(unique))
+	for i := range final {
+		final[i] = i
+	}
+	if len(unique) > limit {
+		contexts := make([][]charContext, len(unique))
+		modes := make([]int, len(unique))
+		for i, index := range cells {
+			context := charContext{color: screen.Colors[i] & 15, bg: screen.cellBackground(i), count: 1}
+			modes[index] |= 1 << screen.cellMode(context.color)
+			found := false
+			for k := range contexts[index] {
+				if contexts[index][k].color == context.color && contexts[index][k].bg == context.bg {
+					contexts[index][k].count++
+					found = true
+					break
+				}
+			}
+			if !found {
+				contexts[index] = append(contexts[index], context)
+			}
+		}
+		final = mergeChars(cells, len(unique), limit, func(a, b int) float64 {
+			if modes[a] != modes[b] {
+				return math.Inf(1)
+			}
+			sum, count := 0.0, 0
+			for _, context := range contexts[a] {
+				sum += float64(context.count) * screen.charError(unique[a], unique[b], context, table)
+				count += context.count
+			}
+			return sum / float64(count)
+		})
+	}
+	numbers := make([]int, len(unique))
+	screen.Charset = []byte{}
+	for i, char := range unique {
+		if final[i] == i {
+			numbers[i] = len(screen.Charset) / 8
+			screen.Charset = append(screen.Charset, char...)
+		}
+	}
+	for i, index := range cells {
+		to := final[index]
+		if to != index {
+			context := charContext{color: screen.Colors[i] & 15, bg: screen.cellBackground(i)}
+			changes = append(changes, CharChange{
+				X:     xoffset + (i%screen.Width)*8,
+				Y:     yoffset + (i/screen.Width)*8,
+				From:  index,
+				To:    numbers[to],
+				Error: screen.charError(unique[index], unique[to], context, table)})
+		}
+		screen.Screen[i] |= byte(numbers[to])
+	}
+	return changes
+}
+
+// cellMode returns 1 if cells with the given color RAM value are shown in
+// multicolor, or 0 if they are shown in hires
+func (screen *TextScreen) cellMode(color byte) uint {
+	if screen.Mode == MulticolorText && color >= 8 {
+		return 1
+	}
+	return 0
+}
+
+// charError returns the summed distance between the pixel colors of two
+// chars shown in the given context
+func (screen *TextScreen) charError(a, b []byte, context charContext, table [][]float64) float64 {
+	sum := 0.0
+	for y := range a {
+		if a[y] == b[y] {
+			continue
+		}
+		for x := 0; x < 8; x++ {
+			sum += table[screen.pixelColor(a[y], context.color, context.bg, x)][screen.pixelColor(b[y], context.color, context.bg, x)]
+		}
+	}
+	return sum
+}
@@ -0,0 +1,152 @@
+package gfx
+
+import (
+	"fmt"
+	img "image"
+	"io"
+)
+
+// TileMap represents a map of metatiles, each made up of a block of chars
+// from a charset. Both the chars of each tile and the tiles of the map are
+// stored row by row, or column by column if ColumnMajor is set.
+type TileMap struct {
+	Tiles       [][]byte
+	Colors      []byte
+	Map         []byte
+	TileWidth   int
+	TileHeight  int
+	Width       int
+	Height      int
+	ColumnMajor bool
+	Recolored   []TileRecolor
+}
+
+// TileRecolor describes a tile whose chars have different colors, which
+// are all shown in the color of the tile. Col and Row give the first
+// position of the tile in the map, Colors the color RAM values of its
+// chars and Changed the number of chars of another color than the tile.
+type TileRecolor struct {
+	Tile     int
+	Col, Row int
+	Colors   []byte
+	Color    byte
+	Changed  int
+}
+
+// Bytes returns the tile definitions as raw bytes, each tile being its
+// chars followed by its color
+func (tiles *TileMap) Bytes() []byte {
+	data := []byte{}
+	for i, tile := range tiles.Tiles {
+		data = append(data, tile...)
+		data = append(data, tiles.Colors[i])
+	}
+	return data
+}
+
+// Tiles splits the screen map of the charset into tiles of the given size
+// in chars, ignoring any chars to the right or below the last whole tile.
+// Identical tiles are only stored once, and the color of each tile is the
+// color used by most of its chars, the tiles whose chars differ in color
+// being listed in Recolored. If more than 256 tiles are needed, all of
+// them are returned along with an error.
+func (charset *Charset) Tiles(width, height int, columnMajor bool) (*TileMap, error) {
+	cols, rows := charset.Width/width, charset.Height/height
+	tiles := TileMap{
+		Tiles:       [][]byte{},
+		Colors:      []byte{},
+		Map:         make([]byte, cols*rows),
+		TileWidth:   width,
+		TileHeight:  height,
+		Width:       cols,
+		Height:      rows,
+		ColumnMajor: columnMajor}
+	indices := map[string]int{}
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			tile := make([]byte, width*height)
+			counts := make([]int, 16)
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					char := charset.Screen[(row*height+y)*charset.Width+col*width+x]
+					tile[tileOffset(x, y, width, height, columnMajor)] = char
+					counts[charset.Colors[char]&15]++
+				}
+			}
+			index, found := indices[string(tile)]
+			if !found {
+				index = len(tiles.Tiles)
+				indices[string(tile)] = index
+				tiles.Tiles = append(tiles.Tiles, tile)
+				majority, used := 0, []byte{}
+				for c, n := range counts {
+					if n > counts[majority] {
+						majority = c
+					}
+					if n > 0 {
+						used = append(used, byte(c))
+					}
+				}
+				tiles.Colors = append(tiles.Colors, byte(majority))
+				if len(used) > 1 {
+					tiles.Recolored = append(tiles.Recolored, TileRecolor{Tile: index, Col: col, Row: row,
+						Colors: used, Color: byte(majority), Changed: width*height - counts[majority]})
+				}
+			}
+			tiles.Map[tileOffset(col, row, cols, rows, columnMajor)] = byte(index)
+		}
+	}
+	if len(tiles.Tiles) > 256 {
+		return &tiles, fmt.Errorf("Image needs %d unique tiles, which is more than 256", len(tiles.Tiles))
+	}
+	return &tiles, nil
+}
+
+// WriteTileRecolorReport writes a line for each recolored tile, followed
+// by the total number of chars changed
+func WriteTileRecolorReport(w io.Writer, recolored []TileRecolor) {
+	total := 0
+	for _, tile := range recolored {
+		fmt.Fprintf(w, "Recolored tile %3d at col=%3d, row=%3d: %v -> %2d, %d chars changed\n",
+			tile.Tile, tile.Col, tile.Row, tile.Colors, tile.Color, tile.Changed)
+		total += tile.Changed
+	}
+	fmt.Fprintf(w, "%d tiles recolored, %d chars changed\n", len(recolored), total)
+}
+
+// TextScreen returns the tile map shown with the charset it was made from
+// as a text screen, with the chars of each tile in the color of the tile
+func (tiles *TileMap) TextScreen(charset *Charset) *TextScreen {
+	screen := charset.TextScreen()
+	screen.Width, screen.Height = tiles.Width*tiles.TileWidth, tiles.Height*tiles.TileHeight
+	screen.Screen = make([]byte, screen.Width*screen.Height)
+	screen.Colors = make([]byte, screen.Width*screen.Height)
+	for row := 0; row < tiles.Height; row++ {
+		for col := 0; col < tiles.Width; col++ {
+			index := tiles.Map[tileOffset(col, row, tiles.Width, tiles.Height, tiles.ColumnMajor)]
+			for y := 0; y < tiles.TileHeight; y++ {
+				for x := 0; x < tiles.TileWidth; x++ {
+					offset := (row*tiles.TileHeight+y)*screen.Width + col*tiles.TileWidth + x
+					screen.Screen[offset] = tiles.Tiles[index][tileOffset(x, y, tiles.TileWidth, tiles.TileHeight, tiles.ColumnMajor)]
+					screen.Colors[offset] = tiles.Colors[index]
+				}
+			}
+		}
+	}
+	return screen
+}
+
+// Render returns the tile map shown with the charset it was made from as
+// a paletted image using the given palette, as given by TextScreen
+func (tiles *TileMap) Render(charset *Charset, palette *Palette) *img.Paletted {
+	return tiles.TextScreen(charset).Render(palette)
+}
+
+// tileOffset returns the offset of x, y in a width x height block stored
+// row by row or column by column
+func tileOffset(x, y, width, height int, columnMajor bool) int {
+	if columnMajor {
+		return x*height + y
+	}
+	return y*width + x
+}